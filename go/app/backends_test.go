@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testBackend opens a storage backend on a temporary file. The flags say
+// what the tests may expect of it beyond ItemRepository.
+type testBackend struct {
+	name string
+	open func(t *testing.T) ItemRepository
+	// aliases is set for backends that are a CategoryAliasRepository.
+	aliases bool
+	// honorsContext is set for backends that give up once ctx is done.
+	honorsContext bool
+}
+
+var testBackends = []testBackend{
+	{
+		name:          StorageSQLite,
+		open:          func(t *testing.T) ItemRepository { return newTestSQLite(t) },
+		aliases:       true,
+		honorsContext: true,
+	},
+	{
+		name: StorageJSON,
+		open: func(t *testing.T) ItemRepository {
+			r, err := newJSONRepository(filepath.Join(t.TempDir(), "items.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { r.Close() })
+			return r
+		},
+	},
+}
+
+// forEachBackend runs fn as a subtest against every backend.
+func forEachBackend(t *testing.T, fn func(t *testing.T, b testBackend, repo ItemRepository)) {
+	for _, b := range testBackends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			fn(t, b, b.open(t))
+		})
+	}
+}
+
+// itemIDs returns the ids of the items of a listing body.
+func itemIDs(t *testing.T, body []byte) []int64 {
+	t.Helper()
+	var page ItemsPage
+	if err := json.Unmarshal(body, &page); err != nil {
+		t.Fatalf("not an item listing: %s", body)
+	}
+	ids := []int64{}
+	for _, item := range page.Items.Items {
+		ids = append(ids, item.ID)
+	}
+	return ids
+}
+
+// wantIDs checks that a response is a listing of the items ids, in order.
+func wantIDs(ids ...int64) func(*testing.T, []byte) {
+	return func(t *testing.T, body []byte) {
+		t.Helper()
+		if ids == nil {
+			ids = []int64{}
+		}
+		if got := itemIDs(t, body); !reflect.DeepEqual(got, ids) {
+			t.Errorf("ids = %v, want %v", got, ids)
+		}
+	}
+}
+
+// wantBody checks that a response contains each of parts.
+func wantBody(parts ...string) func(*testing.T, []byte) {
+	return func(t *testing.T, body []byte) {
+		t.Helper()
+		for _, part := range parts {
+			if !strings.Contains(string(body), part) {
+				t.Errorf("body does not contain %s: %s", part, body)
+			}
+		}
+	}
+}
+
+// TestBackendHandlers runs the same requests through the handlers against
+// every backend. The steps share the repository and run in order.
+func TestBackendHandlers(t *testing.T) {
+	canceled := func(req func() *http.Request) func() *http.Request {
+		return func() *http.Request {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return req().WithContext(ctx)
+		}
+	}
+	steps := []struct {
+		name string
+		req  func() *http.Request
+		// status is the expected status, unless the backend lacks what
+		// the step needs and unsupported is set.
+		status      int
+		unsupported int
+		needs       func(testBackend) bool
+		check       func(*testing.T, []byte)
+	}{
+		{name: "add form", req: form(http.MethodPost, "/items", "name", "jacket", "category", "fashion", "price", "1500"), status: http.StatusCreated},
+		{name: "add json", req: jsonBody(http.MethodPost, "/items", `{"name":"shirt","category":" Fashion ","price":3000}`), status: http.StatusCreated, check: wantBody(`"category":"fashion"`)},
+		{name: "add bulk", req: jsonBody(http.MethodPost, "/items/bulk", `[{"name":"tent","category":"outdoor","price":2500}]`), status: http.StatusCreated},
+		{name: "add invalid", req: form(http.MethodPost, "/items", "category", "fashion"), status: http.StatusBadRequest},
+		{name: "list", req: get("/items"), status: http.StatusOK, check: wantIDs(1, 2, 3)},
+		{name: "list category", req: get("/items?category=fashion"), status: http.StatusOK, check: wantIDs(1, 2)},
+		{name: "list by name", req: get("/items?sort=name"), status: http.StatusOK, check: wantIDs(1, 2, 3)},
+		{name: "list newest", req: get("/items?sort=newest"), status: http.StatusOK, check: wantIDs(3, 2, 1)},
+		{name: "list price range", req: get("/items?price_min=2000&price_max=2999"), status: http.StatusOK, check: wantIDs(3)},
+		{name: "get", req: get("/items/1"), status: http.StatusOK, check: wantBody(`"name":"jacket"`)},
+		{name: "get missing", req: get("/items/99"), status: http.StatusNotFound},
+		{name: "search name", req: get("/search?keyword=JACK"), status: http.StatusOK, check: wantIDs(1)},
+		{name: "search category", req: get("/search?keyword=outdoor"), status: http.StatusOK, check: wantIDs(3)},
+		{name: "structured search", req: jsonBody(http.MethodPost, "/search", `{"filters":{"any":[{"category":"outdoor"},{"min_price":3000}]},"sort":"-id"}`), status: http.StatusOK, check: wantIDs(3, 2)},
+		{name: "count", req: get("/items/count?category=fashion"), status: http.StatusOK, check: wantBody(`"count":2`)},
+		{name: "update", req: form(http.MethodPut, "/items/1", "name", "coat", "category", "fashion", "price", "1800"), status: http.StatusOK},
+		{name: "get updated", req: get("/items/1"), status: http.StatusOK, check: wantBody(`"name":"coat"`, `"price":1800`)},
+		{name: "trash", req: form(http.MethodDelete, "/items/2"), status: http.StatusOK},
+		{name: "list without trashed", req: get("/items"), status: http.StatusOK, check: wantIDs(1, 3)},
+		{name: "list trash", req: get("/items/trash"), status: http.StatusOK, check: wantIDs(2)},
+		{name: "restore", req: form(http.MethodPost, "/items/2/restore"), status: http.StatusOK},
+		{name: "categories", req: get("/categories"), status: http.StatusOK, check: wantBody(`"name":"fashion","item_count":2`, `"name":"outdoor","item_count":1`)},
+		{name: "rename category", req: form(http.MethodPut, "/categories/2", "name", "camping"), status: http.StatusOK, check: wantBody(`"name":"camping"`)},
+		{name: "list renamed category", req: get("/items?category=camping"), status: http.StatusOK, check: wantIDs(3)},
+		{name: "merge category", req: form(http.MethodPost, "/categories/2/merge", "target_id", "1"), status: http.StatusOK, check: wantBody(`"moved_items":1`)},
+		{name: "list merged category", req: get("/categories/1/items"), status: http.StatusOK, check: wantIDs(1, 2, 3)},
+		{name: "purge", req: form(http.MethodDelete, "/items/3?permanent=true"), status: http.StatusOK},
+		{name: "get purged", req: get("/items/3"), status: http.StatusNotFound},
+		{name: "export", req: get("/items/export"), status: http.StatusOK, check: wantBody("coat,fashion", "shirt,fashion")},
+		{
+			name: "add alias", req: form(http.MethodPost, "/admin/category-aliases", "alias", "clothes", "category_id", "1"),
+			status: http.StatusCreated, unsupported: http.StatusNotFound, needs: func(b testBackend) bool { return b.aliases },
+		},
+		{
+			name: "list aliases", req: get("/admin/category-aliases"),
+			status: http.StatusOK, unsupported: http.StatusNotFound, needs: func(b testBackend) bool { return b.aliases },
+			check: wantBody(`"clothes"`),
+		},
+		{
+			// A backend ignoring ctx answers as if the client were still there.
+			name: "canceled request", req: canceled(get("/items/1")),
+			status: http.StatusServiceUnavailable, unsupported: http.StatusOK, needs: func(b testBackend) bool { return b.honorsContext },
+		},
+	}
+
+	forEachBackend(t, func(t *testing.T, b testBackend, repo ItemRepository) {
+		e := newTestServer(t, testConfig(t), repo)
+		for _, step := range steps {
+			want, check := step.status, step.check
+			if step.needs != nil && !step.needs(b) {
+				want, check = step.unsupported, nil
+			}
+			rec := serve(e, step.req())
+			if rec.Code != want {
+				t.Fatalf("%s: status = %d, want %d; body: %s", step.name, rec.Code, want, rec.Body)
+			}
+			if check != nil {
+				t.Run(step.name, func(t *testing.T) { check(t, rec.Body.Bytes()) })
+			}
+		}
+	})
+}
+
+// TestConcurrentCheckCategoryId creates the same new category from
+// several goroutines at once, which must all get the one row created.
+func TestConcurrentCheckCategoryId(t *testing.T) {
+	const workers = 16
+	forEachBackend(t, func(t *testing.T, _ testBackend, repo ItemRepository) {
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		ids := make([]int64, workers)
+		errs := make([]error, workers)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				<-start
+				ids[w], errs[w] = repo.CheckCategoryId(context.Background(), "fashion")
+			}(w)
+		}
+		close(start)
+		wg.Wait()
+		for w := 0; w < workers; w++ {
+			if errs[w] != nil {
+				t.Fatalf("worker %d: %s", w, errs[w])
+			}
+			if ids[w] != ids[0] {
+				t.Errorf("worker %d got category %d, worker 0 got %d", w, ids[w], ids[0])
+			}
+		}
+
+		categories, err := repo.ReadCategories(context.Background(), "", ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(categories.Categories); n != 1 {
+			t.Errorf("%d categories, want 1: %v", n, categories.Categories)
+		}
+	})
+}
+
+// TestEmptyListings checks the exact bodies of listings without items,
+// whose items must be [] and never null.
+func TestEmptyListings(t *testing.T) {
+	tests := []struct {
+		name string
+		req  func() *http.Request
+		want string
+	}{
+		{name: "list", req: get("/items"), want: `{"items":[],"total":0,"next_cursor":""}`},
+		{name: "list sorted", req: get("/items?sort=name"), want: `{"items":[],"total":0}`},
+		{name: "trash", req: get("/items/trash"), want: `{"items":[],"total":0}`},
+		{name: "search", req: get("/search?keyword=jacket"), want: `{"items":[],"total":0}`},
+		{name: "structured search", req: jsonBody(http.MethodPost, "/search", `{"keyword":"jacket"}`), want: `{"items":[]}`},
+		{name: "category items", req: get("/categories/1/items"), want: `{"items":[],"total":0}`},
+	}
+	forEachBackend(t, func(t *testing.T, _ testBackend, repo ItemRepository) {
+		// The category exists, without items.
+		if _, err := repo.CheckCategoryId(context.Background(), "fashion"); err != nil {
+			t.Fatal(err)
+		}
+		e := newTestServer(t, testConfig(t), repo)
+		for _, tt := range tests {
+			rec := serve(e, tt.req())
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s: status = %d, want 200; body: %s", tt.name, rec.Code, rec.Body)
+			}
+			if got := strings.TrimSuffix(rec.Body.String(), "\n"); got != tt.want {
+				t.Errorf("%s: body = %s, want %s", tt.name, got, tt.want)
+			}
+		}
+	})
+}
+
+// TestPaging pages through GET /items with cursors and with offsets.
+func TestPaging(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, _ testBackend, repo ItemRepository) {
+		e := newTestServer(t, testConfig(t), repo)
+		add := func(name, category string) {
+			t.Helper()
+			if rec := serve(e, form(http.MethodPost, "/items", "name", name, "category", category)()); rec.Code != http.StatusCreated {
+				t.Fatalf("add: status = %d; body: %s", rec.Code, rec.Body)
+			}
+		}
+		for i, category := range []string{"a", "b", "a", "b", "a"} {
+			add(fmt.Sprintf("item %d", i+1), category)
+		}
+		page := func(target string) ([]int64, ItemsPage) {
+			t.Helper()
+			rec := serve(e, get(target)())
+			if rec.Code != http.StatusOK {
+				t.Fatalf("%s: status = %d; body: %s", target, rec.Code, rec.Body)
+			}
+			var p ItemsPage
+			if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			return itemIDs(t, rec.Body.Bytes()), p
+		}
+		// follow walks the cursors from query and returns the pages.
+		follow := func(query string) [][]int64 {
+			t.Helper()
+			var pages [][]int64
+			target := "/items?" + query
+			for {
+				ids, p := page(target)
+				pages = append(pages, ids)
+				if p.NextCursor == nil {
+					t.Fatalf("%s: no next_cursor", target)
+				}
+				if *p.NextCursor == "" {
+					return pages
+				}
+				if len(pages) == 10 {
+					t.Fatalf("%s: no last page", target)
+				}
+				target = "/items?" + query + "&cursor=" + url.QueryEscape(*p.NextCursor)
+			}
+		}
+
+		t.Run("cursor", func(t *testing.T) {
+			got := follow("limit=2")
+			if want := [][]int64{{1, 2}, {3, 4}, {5}}; !reflect.DeepEqual(got, want) {
+				t.Errorf("pages = %v, want %v", got, want)
+			}
+		})
+
+		t.Run("cursor with inserts", func(t *testing.T) {
+			// An item added between pages neither shifts nor repeats
+			// the ones already seen, and shows up on a later page.
+			_, first := page("/items?limit=2")
+			add("item 6", "b")
+			ids, second := page("/items?limit=2&cursor=" + url.QueryEscape(*first.NextCursor))
+			if want := []int64{3, 4}; !reflect.DeepEqual(ids, want) {
+				t.Errorf("second page = %v, want %v", ids, want)
+			}
+			ids, _ = page("/items?limit=2&cursor=" + url.QueryEscape(*second.NextCursor))
+			if want := []int64{5, 6}; !reflect.DeepEqual(ids, want) {
+				t.Errorf("third page = %v, want %v", ids, want)
+			}
+		})
+
+		t.Run("cursor with category", func(t *testing.T) {
+			got := follow("category=a&limit=2")
+			if want := [][]int64{{1, 3}, {5}}; !reflect.DeepEqual(got, want) {
+				t.Errorf("pages = %v, want %v", got, want)
+			}
+			if _, p := page("/items?category=a&limit=2"); p.Total != 3 {
+				t.Errorf("total = %d, want 3", p.Total)
+			}
+		})
+
+		t.Run("offset", func(t *testing.T) {
+			ids, p := page("/items?limit=2&offset=2")
+			if want := []int64{3, 4}; !reflect.DeepEqual(ids, want) {
+				t.Errorf("ids = %v, want %v", ids, want)
+			}
+			if p.NextCursor != nil {
+				t.Errorf("next_cursor = %q, want none with an offset", *p.NextCursor)
+			}
+			if p.Total != 6 {
+				t.Errorf("total = %d, want 6", p.Total)
+			}
+			if ids, _ := page("/items?category=b&limit=2&offset=1"); !reflect.DeepEqual(ids, []int64{4, 6}) {
+				t.Errorf("category b from offset 1 = %v, want [4 6]", ids)
+			}
+		})
+
+		t.Run("invalid", func(t *testing.T) {
+			_, p := page("/items?limit=2")
+			cursor := url.QueryEscape(*p.NextCursor)
+			for target, code := range map[string]string{
+				"/items?cursor=not-a-cursor":             CodeInvalidCursor,
+				"/items?cursor=" + cursor + "&sort=name": CodeInvalidQuery,
+				"/items?cursor=" + cursor + "&offset=2":  CodeInvalidQuery,
+			} {
+				rec := serve(e, get(target)())
+				if rec.Code != http.StatusBadRequest || errorCode(rec) != code {
+					t.Errorf("%s: status = %d, code = %q, want 400 %s", target, rec.Code, errorCode(rec), code)
+				}
+			}
+		})
+	})
+}
+
+func TestRepositoryCounts(t *testing.T) {
+	price := func(p int64) *int64 { return &p }
+	countTests := []struct {
+		name     string
+		keywords string
+		opts     ListOptions
+		want     int
+	}{
+		{name: "all", want: 3},
+		{name: "category", opts: ListOptions{Category: "Fashion"}, want: 2},
+		{name: "keyword", keywords: "jacket", want: 1},
+		{name: "keyword on category", keywords: "outdoor", want: 1},
+		{name: "price min", opts: ListOptions{PriceMin: price(2000)}, want: 2},
+		{name: "price max and category", opts: ListOptions{Category: "fashion", PriceMax: price(2000)}, want: 1},
+		{name: "trash", opts: ListOptions{Deleted: OnlyDeleted}, want: 1},
+		{name: "with trash", opts: ListOptions{Deleted: IncludeDeleted}, want: 4},
+		{name: "no match", keywords: "sofa", want: 0},
+	}
+	categoryTests := []struct {
+		name     string
+		keywords string
+		opts     ListOptions
+		want     map[string]int
+	}{
+		{name: "all", want: map[string]int{"books": 0, "fashion": 2, "outdoor": 1}},
+		{name: "keyword", keywords: "jacket", want: map[string]int{"books": 0, "fashion": 1, "outdoor": 0}},
+		{name: "price min", opts: ListOptions{PriceMin: price(2000)}, want: map[string]int{"books": 0, "fashion": 1, "outdoor": 1}},
+		{name: "category ignored", opts: ListOptions{Category: "fashion"}, want: map[string]int{"books": 0, "fashion": 2, "outdoor": 1}},
+	}
+
+	forEachBackend(t, func(t *testing.T, _ testBackend, repo ItemRepository) {
+		ctx := context.Background()
+		for _, item := range []Item{
+			{Name: "jacket", Category: "fashion", Price: 1000},
+			{Name: "shirt", Category: "fashion", Price: 3000},
+			{Name: "tent", Category: "outdoor", Price: 2500},
+			{Name: "jacket", Category: "outdoor", Price: 500},
+		} {
+			if _, err := repo.SaveItem(ctx, item); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := repo.TrashItem(ctx, 4); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.CheckCategoryId(ctx, "books"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, tt := range countTests {
+			n, err := repo.CountItems(ctx, tt.keywords, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != tt.want {
+				t.Errorf("CountItems %s = %d, want %d", tt.name, n, tt.want)
+			}
+		}
+		for _, tt := range categoryTests {
+			categories, err := repo.ReadCategories(ctx, tt.keywords, tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]int{}
+			for _, c := range categories.Categories {
+				got[c.Name] = c.ItemCount
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReadCategories %s = %v, want %v", tt.name, got, tt.want)
+			}
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// ItemsCacheTTL bounds how long a listing is served from memory. Writes
+	// through this server invalidate it at once, so the TTL only matters
+	// for changes made behind its back, such as --import-json.
+	ItemsCacheTTL = 5 * time.Second
+	// ItemsCacheSize caps the number of cached listings.
+	ItemsCacheSize = 256
+)
+
+// itemsCache keeps recent ReadItems results keyed by their ListOptions.
+// Handlers must call invalidate after every call that may have changed
+// items or category names, before they respond.
+type itemsCache struct {
+	mu      sync.Mutex
+	entries map[listKey]cachedPage
+	// gen is bumped by invalidate, so that a read that started before a
+	// write does not store what it read once the write is done.
+	gen uint64
+	// epoch tells apart the generations of different processes, which
+	// all start at 0.
+	epoch string
+
+	hits, misses atomic.Int64
+}
+
+// listKey is ListOptions with the price bounds dereferenced, so equal
+// options compare equal.
+type listKey struct {
+	category, sort     string
+	hasMin, hasMax     bool
+	priceMin, priceMax int64
+	deleted            DeletedFilter
+	Page
+}
+
+type cachedPage struct {
+	page    ItemsPage
+	expires time.Time
+}
+
+// CacheStats is the body of GET /admin/cache.
+type CacheStats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+}
+
+func newItemsCache() *itemsCache {
+	return &itemsCache{
+		entries: map[listKey]cachedPage{},
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+	}
+}
+
+func newListKey(opts ListOptions) listKey {
+	k := listKey{category: opts.Category, sort: opts.Sort, deleted: opts.Deleted, Page: opts.Page}
+	if opts.PriceMin != nil {
+		k.hasMin, k.priceMin = true, *opts.PriceMin
+	}
+	if opts.PriceMax != nil {
+		k.hasMax, k.priceMax = true, *opts.PriceMax
+	}
+	return k
+}
+
+// readItems returns the listing for opts from the cache, or from repo if
+// it is not cached or has expired.
+func (ic *itemsCache) readItems(ctx context.Context, repo ItemRepository, opts ListOptions) (ItemsPage, error) {
+	key := newListKey(opts)
+	now := time.Now()
+
+	ic.mu.Lock()
+	entry, ok := ic.entries[key]
+	gen := ic.gen
+	ic.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		ic.hits.Add(1)
+		return copyPage(entry.page), nil
+	}
+	ic.misses.Add(1)
+
+	page, err := repo.ReadItems(ctx, opts)
+	if err != nil {
+		return ItemsPage{}, err
+	}
+
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	if ic.gen != gen {
+		return page, nil
+	}
+	if len(ic.entries) >= ItemsCacheSize {
+		for k, e := range ic.entries {
+			if !now.Before(e.expires) {
+				delete(ic.entries, k)
+			}
+		}
+	}
+	if len(ic.entries) < ItemsCacheSize {
+		ic.entries[key] = cachedPage{page: copyPage(page), expires: now.Add(ItemsCacheTTL)}
+	}
+	return page, nil
+}
+
+// copyPage copies the items of page, which handlers modify in place.
+func copyPage(page ItemsPage) ItemsPage {
+	page.Items.Items = append([]Item{}, page.Items.Items...)
+	return page
+}
+
+func (ic *itemsCache) invalidate() {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	ic.gen++
+	ic.entries = map[listKey]cachedPage{}
+}
+
+// version identifies the state of the listings: it changes on every
+// invalidate, and so with every write made through this server.
+func (ic *itemsCache) version() string {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return ic.epoch + "-" + strconv.FormatUint(ic.gen, 10)
+}
+
+func (ic *itemsCache) stats() CacheStats {
+	ic.mu.Lock()
+	defer ic.mu.Unlock()
+	return CacheStats{Hits: ic.hits.Load(), Misses: ic.misses.Load(), Entries: len(ic.entries)}
+}
+
+func (s ServerImpl) getCacheStats(c echo.Context) error {
+	return c.JSON(http.StatusOK, s.cache.stats())
+}
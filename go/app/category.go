@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+type CategoryAlias struct {
+	Alias      string `json:"alias"`
+	CategoryID int64  `json:"category_id"`
+	Category   string `json:"category"`
+}
+
+type CategoryAliases struct {
+	Aliases []CategoryAlias `json:"aliases"`
+}
+
+type MergeResult struct {
+	CategoryAlias
+	MovedItems int64 `json:"moved_items"`
+}
+
+// CategoryMerge is the result of POST /categories/:id/merge: the category
+// the items now belong to and how many were moved.
+type CategoryMerge struct {
+	Category
+	MovedItems int64 `json:"moved_items"`
+}
+
+var (
+	errCategoryNotFound = errors.New("category not found")
+	errAliasConflict    = errors.New("alias conflicts with an existing category or alias")
+	errSameCategory     = errors.New("cannot merge a category into itself")
+	errCategoryExists   = errors.New("category name already exists")
+)
+
+// AddAlias registers alias as another name for the category with the given
+// id. An alias may not shadow an existing category or alias.
+func (r *sqliteRepository) AddAlias(ctx context.Context, alias string, categoryId int64) (CategoryAlias, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	tx, err := r.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return CategoryAlias{}, err
+	}
+	defer tx.Rollback()
+
+	res := CategoryAlias{Alias: alias, CategoryID: categoryId}
+	if err := tx.QueryRowContext(ctx, "SELECT name FROM categories WHERE id = ?", categoryId).Scan(&res.Category); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return CategoryAlias{}, errCategoryNotFound
+		}
+		return CategoryAlias{}, err
+	}
+	if taken, err := aliasTaken(ctx, tx, alias); err != nil {
+		return CategoryAlias{}, err
+	} else if taken {
+		return CategoryAlias{}, errAliasConflict
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO category_aliases (alias, category_id) VALUES (?, ?)", alias, categoryId); err != nil {
+		return CategoryAlias{}, err
+	}
+	return res, tx.Commit()
+}
+
+func aliasTaken(ctx context.Context, tx *sql.Tx, alias string) (bool, error) {
+	var n int
+	err := tx.QueryRowContext(ctx, `SELECT (SELECT COUNT(*) FROM categories WHERE name = ?)
+		+ (SELECT COUNT(*) FROM category_aliases WHERE alias = ?)`, alias, alias).Scan(&n)
+	return n > 0, err
+}
+
+func (r *sqliteRepository) ReadAliases(ctx context.Context) (CategoryAliases, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, `SELECT category_aliases.alias, categories.id, categories.name
+		FROM category_aliases JOIN categories ON category_aliases.category_id = categories.id
+		ORDER BY category_aliases.alias`)
+	if err != nil {
+		return CategoryAliases{}, err
+	}
+	defer rows.Close()
+
+	aliases := CategoryAliases{Aliases: []CategoryAlias{}}
+	for rows.Next() {
+		var a CategoryAlias
+		if err := rows.Scan(&a.Alias, &a.CategoryID, &a.Category); err != nil {
+			return CategoryAliases{}, err
+		}
+		aliases.Aliases = append(aliases.Aliases, a)
+	}
+	return aliases, rows.Err()
+}
+
+func (r *sqliteRepository) DeleteAlias(ctx context.Context, alias string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	res, err := r.writer.ExecContext(ctx, "DELETE FROM category_aliases WHERE alias = ?", alias)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// MergeCategoryIntoAlias turns the category fromId into an alias of toId:
+// its items and aliases are repointed to toId and the row is removed.
+func (r *sqliteRepository) MergeCategoryIntoAlias(ctx context.Context, fromId, toId int64) (MergeResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	if fromId == toId {
+		return MergeResult{}, errSameCategory
+	}
+	tx, err := r.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return MergeResult{}, err
+	}
+	defer tx.Rollback()
+
+	var res MergeResult
+	res.CategoryID = toId
+	if err := tx.QueryRowContext(ctx, "SELECT name FROM categories WHERE id = ?", fromId).Scan(&res.Alias); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return MergeResult{}, errCategoryNotFound
+		}
+		return MergeResult{}, err
+	}
+	if err := tx.QueryRowContext(ctx, "SELECT name FROM categories WHERE id = ?", toId).Scan(&res.Category); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return MergeResult{}, errCategoryNotFound
+		}
+		return MergeResult{}, err
+	}
+
+	if res.MovedItems, err = moveCategory(ctx, tx, fromId, toId); err != nil {
+		return MergeResult{}, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO category_aliases (alias, category_id) VALUES (?, ?)", res.Alias, toId); err != nil {
+		return MergeResult{}, err
+	}
+	return res, tx.Commit()
+}
+
+// moveCategory repoints the items and aliases of the category fromId to
+// toId and deletes its row, returning the number of items moved. The
+// references have to go first since foreign keys are enforced.
+func moveCategory(ctx context.Context, tx *sql.Tx, fromId, toId int64) (int64, error) {
+	res, err := tx.ExecContext(ctx, "UPDATE items SET category_id = ? WHERE category_id = ?", toId, fromId)
+	if err != nil {
+		return 0, err
+	}
+	moved, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE category_aliases SET category_id = ? WHERE category_id = ?", toId, fromId); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM categories WHERE id = ?", fromId); err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
+
+// RenameCategory renames the category. The new name may not be taken by
+// another category or by an alias, which would otherwise shadow it.
+func (r *sqliteRepository) RenameCategory(ctx context.Context, id int64, name string) (Category, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	tx, err := r.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return Category{}, err
+	}
+	defer tx.Rollback()
+
+	var old string
+	if err := tx.QueryRowContext(ctx, "SELECT name FROM categories WHERE id = ?", id).Scan(&old); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Category{}, errCategoryNotFound
+		}
+		return Category{}, err
+	}
+	if old == name {
+		return Category{ID: id, Name: name}, nil
+	}
+	if taken, err := aliasTaken(ctx, tx, name); err != nil {
+		return Category{}, err
+	} else if taken {
+		return Category{}, errCategoryExists
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE categories SET name = ? WHERE id = ?", name, id); err != nil {
+		return Category{}, err
+	}
+	return Category{ID: id, Name: name}, tx.Commit()
+}
+
+func (r *sqliteRepository) MergeCategory(ctx context.Context, fromId, toId int64) (CategoryMerge, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	if fromId == toId {
+		return CategoryMerge{}, errSameCategory
+	}
+	tx, err := r.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return CategoryMerge{}, err
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM categories WHERE id = ?", fromId).Scan(&n); err != nil {
+		return CategoryMerge{}, err
+	}
+	if n == 0 {
+		return CategoryMerge{}, errCategoryNotFound
+	}
+	res := CategoryMerge{Category: Category{ID: toId}}
+	if err := tx.QueryRowContext(ctx, "SELECT name FROM categories WHERE id = ?", toId).Scan(&res.Name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return CategoryMerge{}, errCategoryNotFound
+		}
+		return CategoryMerge{}, err
+	}
+	if res.MovedItems, err = moveCategory(ctx, tx, fromId, toId); err != nil {
+		return CategoryMerge{}, err
+	}
+	return res, tx.Commit()
+}
+
+// getCategories lists the categories with their item_count, which takes
+// the same filters and keyword as GET /items/count, category aside.
+func (s ServerImpl) getCategories(c echo.Context) error {
+	opts, err := parseListFilters(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidQuery, err.Error())
+	}
+	categories, err := s.repo.ReadCategories(c.Request().Context(), c.QueryParam("keyword"), opts)
+	if err != nil {
+		c.Logger().Errorf("Error while reading categories: %s", err)
+		return dbError(err, "Error while reading categories")
+	}
+	return c.JSON(http.StatusOK, categories)
+}
+
+// getCategoryItems lists the items of one category, taking the same
+// query parameters as GET /items.
+func (s ServerImpl) getCategoryItems(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidID, "Category id must be an integer")
+	}
+	opts, err := parseListOptions(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidQuery, err.Error())
+	}
+	category, err := s.repo.GetCategory(c.Request().Context(), id)
+	if errors.Is(err, errCategoryNotFound) {
+		return newAPIError(http.StatusNotFound, CodeCategoryNotFound, "Category not found")
+	}
+	if err != nil {
+		c.Logger().Errorf("Error while reading category with ID %d: %s", id, err)
+		return dbError(err, "Error while reading category")
+	}
+
+	if s.listNotModified(c) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	opts.Category = category.Name
+	items, err := s.cache.readItems(c.Request().Context(), s.repo, opts)
+	if err != nil {
+		c.Logger().Errorf("Error while reading items of category %d: %s", id, err)
+		return dbError(err, "Error while reading items")
+	}
+	s.setImageURLs(c, items.Items)
+	return c.JSON(http.StatusOK, items)
+}
+
+func (s ServerImpl) addCategoryAlias(c echo.Context) error {
+	alias := normalizeCategory(c.FormValue("alias"))
+	if alias == "" {
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "alias is required")
+	}
+	categoryId, err := strconv.ParseInt(c.FormValue("category_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidID, "category_id must be an integer")
+	}
+
+	res, err := s.aliases.AddAlias(c.Request().Context(), alias, categoryId)
+	switch {
+	case errors.Is(err, errCategoryNotFound):
+		return newAPIError(http.StatusNotFound, CodeCategoryNotFound, "Category not found")
+	case errors.Is(err, errAliasConflict):
+		return newAPIError(http.StatusConflict, CodeConflict, "Alias already exists as a category or alias: "+alias)
+	case err != nil:
+		c.Logger().Errorf("Error while adding category alias: %s", err)
+		return dbError(err, "Error while adding category alias")
+	}
+	return c.JSON(http.StatusCreated, res)
+}
+
+func (s ServerImpl) getCategoryAliases(c echo.Context) error {
+	aliases, err := s.aliases.ReadAliases(c.Request().Context())
+	if err != nil {
+		c.Logger().Errorf("Error while reading category aliases: %s", err)
+		return dbError(err, "Error while reading category aliases")
+	}
+	return c.JSON(http.StatusOK, aliases)
+}
+
+func (s ServerImpl) deleteCategoryAlias(c echo.Context) error {
+	alias := normalizeCategory(c.Param("alias"))
+	deleted, err := s.aliases.DeleteAlias(c.Request().Context(), alias)
+	if err != nil {
+		c.Logger().Errorf("Error while deleting category alias: %s", err)
+		return dbError(err, "Error while deleting category alias")
+	}
+	if !deleted {
+		return newAPIError(http.StatusNotFound, CodeNotFound, "Alias not found: "+alias)
+	}
+	return c.JSON(http.StatusOK, Response{Message: "alias deleted: " + alias})
+}
+
+func (s ServerImpl) mergeCategoryAlias(c echo.Context) error {
+	fromId, err := strconv.ParseInt(c.FormValue("from_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidID, "from_id must be an integer")
+	}
+	toId, err := strconv.ParseInt(c.FormValue("to_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidID, "to_id must be an integer")
+	}
+
+	res, err := s.aliases.MergeCategoryIntoAlias(c.Request().Context(), fromId, toId)
+	s.cache.invalidate()
+	switch {
+	case errors.Is(err, errSameCategory):
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "from_id and to_id must differ")
+	case errors.Is(err, errCategoryNotFound):
+		return newAPIError(http.StatusNotFound, CodeCategoryNotFound, "Category not found")
+	case err != nil:
+		c.Logger().Errorf("Error while merging categories: %s", err)
+		return dbError(err, "Error while merging categories")
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// renameCategory implements PUT /categories/:id, taking the new name in
+// the name form field.
+func (s ServerImpl) renameCategory(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidID, "Category id must be an integer")
+	}
+	name := normalizeCategory(c.FormValue("name"))
+	if name == "" {
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "name is required")
+	}
+
+	category, err := s.repo.RenameCategory(c.Request().Context(), id, name)
+	s.cache.invalidate()
+	switch {
+	case errors.Is(err, errCategoryNotFound):
+		return newAPIError(http.StatusNotFound, CodeCategoryNotFound, "Category not found")
+	case errors.Is(err, errCategoryExists):
+		return newAPIError(http.StatusConflict, CodeConflict, "Category already exists: "+name)
+	case err != nil:
+		c.Logger().Errorf("Error while renaming category %d: %s", id, err)
+		return dbError(err, "Error while renaming category")
+	}
+	return c.JSON(http.StatusOK, category)
+}
+
+// mergeCategory implements POST /categories/:id/merge, moving the items
+// of the category into the one given by the target_id form field.
+func (s ServerImpl) mergeCategory(c echo.Context) error {
+	fromId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidID, "Category id must be an integer")
+	}
+	toId, err := strconv.ParseInt(c.FormValue("target_id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidID, "target_id must be an integer")
+	}
+
+	res, err := s.repo.MergeCategory(c.Request().Context(), fromId, toId)
+	s.cache.invalidate()
+	switch {
+	case errors.Is(err, errSameCategory):
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "target_id must differ from the category id")
+	case errors.Is(err, errCategoryNotFound):
+		return newAPIError(http.StatusNotFound, CodeCategoryNotFound, "Category not found")
+	case err != nil:
+		c.Logger().Errorf("Error while merging category %d into %d: %s", fromId, toId, err)
+		return dbError(err, "Error while merging categories")
+	}
+	return c.JSON(http.StatusOK, res)
+}
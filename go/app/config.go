@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/labstack/gommon/bytes"
+	"github.com/labstack/gommon/log"
+)
+
+// Config is the server configuration. It is read from the environment,
+// with CONFIG_FILE optionally naming a file of KEY=VALUE lines that
+// override it. Fields tagged reload:"true" are swapped into the running
+// server on SIGHUP; the others only take effect after a restart.
+type Config struct {
+	Port        string `env:"PORT"`
+	Storage     string `env:"STORAGE"`
+	StoragePath string `env:"STORAGE_PATH"`
+	// DBPath is the sqlite database, used unless StoragePath is set.
+	DBPath   string `env:"DB_PATH"`
+	ImageDir string `env:"IMAGE_DIR"`
+	// ServeFrontend serves the embedded frontend on the paths no API
+	// route claims.
+	ServeFrontend bool `env:"SERVE_FRONTEND"`
+
+	AllowOrigins []string `env:"FRONT_URL" reload:"true"`
+	LogLevel     string   `env:"LOG_LEVEL" reload:"true"`
+	// BodyLimit caps request bodies and image uploads, in bytes; 0
+	// disables it.
+	BodyLimit          int64  `env:"BODY_LIMIT" reload:"true"`
+	MaintenanceMessage string `env:"MAINTENANCE_MESSAGE" reload:"true"`
+	// PublicURL is the base of the image URLs in item responses. By
+	// default it is the scheme and host of each request.
+	PublicURL string `env:"PUBLIC_URL" reload:"true"`
+	// CreateRate limits item creation per client IP, in requests per
+	// second, allowing bursts of CreateBurst; 0 disables it.
+	CreateRate  float64 `env:"CREATE_RATE" reload:"true"`
+	CreateBurst int     `env:"CREATE_BURST" reload:"true"`
+	// APIToken is the bearer token required on write requests; "" lets
+	// anyone write.
+	APIToken string `env:"API_TOKEN" reload:"true" secret:"true"`
+	// WebhookURL is POSTed an ItemCreatedEvent for every new item, signed
+	// with WebhookSecret unless it is ""; "" disables the webhook.
+	WebhookURL    string `env:"WEBHOOK_URL" reload:"true"`
+	WebhookSecret string `env:"WEBHOOK_SECRET" reload:"true" secret:"true"`
+}
+
+// DefaultBodyLimit is the BodyLimit used when BODY_LIMIT is not set.
+const DefaultBodyLimit = 10 << 20
+
+// DefaultCreateRate and DefaultCreateBurst are used when CREATE_RATE and
+// CREATE_BURST are not set.
+const (
+	DefaultCreateRate  = 1
+	DefaultCreateBurst = 10
+)
+
+var logLevels = map[string]log.Lvl{
+	"debug": log.DEBUG,
+	"info":  log.INFO,
+	"warn":  log.WARN,
+	"error": log.ERROR,
+	"off":   log.OFF,
+}
+
+// loadConfig builds the Config from the environment and CONFIG_FILE.
+func loadConfig() (Config, error) {
+	vars := map[string]string{}
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			vars[k] = v
+		}
+	}
+	if name := vars["CONFIG_FILE"]; name != "" {
+		if err := readConfigFile(name, vars); err != nil {
+			return Config{}, err
+		}
+	}
+
+	cfg := Config{
+		Port:          "9000",
+		Storage:       vars["STORAGE"],
+		StoragePath:   vars["STORAGE_PATH"],
+		DBPath:        DBPath,
+		ImageDir:      ImgDir,
+		ServeFrontend: true,
+		AllowOrigins:  []string{"http://localhost:3000"},
+		LogLevel:      "info",
+		BodyLimit:     DefaultBodyLimit,
+		CreateRate:    DefaultCreateRate,
+		CreateBurst:   DefaultCreateBurst,
+	}
+	if v := vars["PORT"]; v != "" {
+		cfg.Port = v
+	}
+	if v := vars["DB_PATH"]; v != "" {
+		cfg.DBPath = v
+	}
+	if v := vars["IMAGE_DIR"]; v != "" {
+		cfg.ImageDir = v
+	}
+	if v := vars["SERVE_FRONTEND"]; v != "" {
+		serve, err := strconv.ParseBool(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid SERVE_FRONTEND %q: must be true or false", v)
+		}
+		cfg.ServeFrontend = serve
+	}
+	if v := vars["FRONT_URL"]; v != "" {
+		cfg.AllowOrigins = nil
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				cfg.AllowOrigins = append(cfg.AllowOrigins, origin)
+			}
+		}
+	}
+	if v := vars["LOG_LEVEL"]; v != "" {
+		cfg.LogLevel = strings.ToLower(v)
+		if _, ok := logLevels[cfg.LogLevel]; !ok {
+			return Config{}, fmt.Errorf("invalid LOG_LEVEL %q", v)
+		}
+	}
+	if v := vars["BODY_LIMIT"]; v != "" {
+		limit, err := bytes.Parse(v)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid BODY_LIMIT %q: %w", v, err)
+		}
+		cfg.BodyLimit = limit
+	}
+	if v := vars["CREATE_RATE"]; v != "" {
+		r, err := strconv.ParseFloat(v, 64)
+		if err != nil || r < 0 {
+			return Config{}, fmt.Errorf("invalid CREATE_RATE %q: must be a non-negative number", v)
+		}
+		cfg.CreateRate = r
+	}
+	if v := vars["CREATE_BURST"]; v != "" {
+		b, err := strconv.Atoi(v)
+		if err != nil || b < 1 {
+			return Config{}, fmt.Errorf("invalid CREATE_BURST %q: must be a positive integer", v)
+		}
+		cfg.CreateBurst = b
+	}
+	cfg.MaintenanceMessage = vars["MAINTENANCE_MESSAGE"]
+	cfg.PublicURL = strings.TrimSuffix(vars["PUBLIC_URL"], "/")
+	cfg.APIToken = vars["API_TOKEN"]
+	if v := vars["WEBHOOK_URL"]; v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return Config{}, fmt.Errorf("invalid WEBHOOK_URL %q: must be an http or https URL", v)
+		}
+		cfg.WebhookURL = v
+	}
+	cfg.WebhookSecret = vars["WEBHOOK_SECRET"]
+	return cfg, nil
+}
+
+// readConfigFile merges the KEY=VALUE lines of the file into vars. Blank
+// lines and lines starting with # are ignored.
+func readConfigFile(name string, vars map[string]string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected KEY=VALUE", name, n)
+		}
+		vars[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), `"`)
+	}
+	return sc.Err()
+}
+
+// configHolder gives the middleware lock-free access to the current
+// Config while a reload swaps it.
+type configHolder struct {
+	v atomic.Pointer[Config]
+}
+
+func newConfigHolder(cfg Config) *configHolder {
+	h := &configHolder{}
+	h.v.Store(&cfg)
+	return h
+}
+
+func (h *configHolder) Load() Config {
+	return *h.v.Load()
+}
+
+// reload swaps in the reloadable fields of next and returns what changed:
+// changed describes the swapped fields, leaving out the values of secret
+// ones, and ignored has the env names of the fields that changed but need
+// a restart, which keep their current value.
+func (h *configHolder) reload(next Config) (changed, ignored []string) {
+	cur := h.Load()
+	merged := cur
+	cv, nv, mv := reflect.ValueOf(cur), reflect.ValueOf(next), reflect.ValueOf(&merged).Elem()
+	for i := 0; i < cv.NumField(); i++ {
+		field := cv.Type().Field(i)
+		if reflect.DeepEqual(cv.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		if field.Tag.Get("reload") != "true" {
+			ignored = append(ignored, field.Tag.Get("env"))
+			continue
+		}
+		mv.Field(i).Set(nv.Field(i))
+		if field.Tag.Get("secret") == "true" {
+			changed = append(changed, field.Tag.Get("env")+" changed")
+			continue
+		}
+		changed = append(changed, fmt.Sprintf("%s: %v -> %v", field.Tag.Get("env"), cv.Field(i).Interface(), nv.Field(i).Interface()))
+	}
+	h.v.Store(&merged)
+	return changed, ignored
+}
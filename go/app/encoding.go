@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// gzipMiddleware compresses responses for clients that accept gzip,
+// except images: JPEG, PNG, GIF and WebP are compressed already, and
+// compressing them again only burns CPU.
+func gzipMiddleware() echo.MiddlewareFunc {
+	gzip := middleware.GzipWithConfig(middleware.GzipConfig{
+		Skipper: func(c echo.Context) bool {
+			return strings.HasPrefix(c.Path(), "/image/")
+		},
+	})
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := gzip(next)
+		return func(c echo.Context) error {
+			// The gzip middleware only drops Content-Encoding from empty
+			// responses after their headers are out, which leaves it on
+			// a 304 or 204.
+			res := c.Response()
+			res.Before(func() {
+				if res.Status == http.StatusNotModified || res.Status == http.StatusNoContent {
+					res.Header().Del(echo.HeaderContentEncoding)
+				}
+			})
+			return h(c)
+		}
+	}
+}
+
+// prettyJSONSerializer indents JSON responses when the request has
+// ?pretty=true. Echo's own check indents for any ?pretty, even
+// ?pretty=false.
+type prettyJSONSerializer struct {
+	echo.DefaultJSONSerializer
+}
+
+func (s prettyJSONSerializer) Serialize(c echo.Context, i interface{}, _ string) error {
+	indent := ""
+	if pretty, _ := strconv.ParseBool(c.QueryParam("pretty")); pretty {
+		indent = "  "
+	}
+	return s.DefaultJSONSerializer.Serialize(c, i, indent)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestGzip(t *testing.T) {
+	cfg := testConfig(t)
+	defaultJPG := copyDefaultImage(t, cfg.ImageDir)
+	e := newTestServer(t, cfg, seedFake())
+	gzipped := func(target string) *http.Request {
+		req := get(target)()
+		req.Header.Set(echo.HeaderAcceptEncoding, "gzip")
+		return req
+	}
+
+	plain := serve(e, get("/items")())
+	if got := plain.Header().Get(echo.HeaderContentEncoding); got != "" {
+		t.Errorf("/items without Accept-Encoding: Content-Encoding = %q, want none", got)
+	}
+
+	rec := serve(e, gzipped("/items"))
+	if got := rec.Header().Get(echo.HeaderContentEncoding); got != "gzip" {
+		t.Fatalf("/items: Content-Encoding = %q, want gzip", got)
+	}
+	if got := rec.Header().Get(echo.HeaderVary); !strings.Contains(got, echo.HeaderAcceptEncoding) {
+		t.Errorf("/items: Vary = %q, want it to list Accept-Encoding", got)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, plain.Body.Bytes()) {
+		t.Errorf("/items: gunzipped body = %s, want %s", body, plain.Body)
+	}
+
+	rec = serve(e, gzipped("/image/default.jpg"))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/image: status = %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Get(echo.HeaderContentEncoding); got != "" {
+		t.Errorf("/image: Content-Encoding = %q, want identity", got)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), defaultJPG) {
+		t.Errorf("/image: body differs from the image file")
+	}
+
+	notModified := gzipped("/items")
+	notModified.Header.Set("If-None-Match", plain.Header().Get("ETag"))
+	rec = serve(e, notModified)
+	if rec.Code != http.StatusNotModified {
+		t.Fatalf("/items with its ETag: status = %d, want 304", rec.Code)
+	}
+	if got := rec.Header().Get(echo.HeaderContentEncoding); got != "" {
+		t.Errorf("304: Content-Encoding = %q, want none", got)
+	}
+}
+
+func TestPrettyJSON(t *testing.T) {
+	e := newTestServer(t, testConfig(t), seedFake())
+	for target, wantIndent := range map[string]bool{
+		"/items/1":              false,
+		"/items/1?pretty=true":  true,
+		"/items/1?pretty=1":     true,
+		"/items/1?pretty=false": false,
+	} {
+		rec := serve(e, get(target)())
+		if got := strings.Contains(rec.Body.String(), "\n  \"id\": 1"); got != wantIndent {
+			t.Errorf("%s: indented = %v, want %v; body: %s", target, got, wantIndent, rec.Body)
+		}
+	}
+}
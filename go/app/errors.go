@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Error codes, in the code field of error responses, let clients tell
+// errors apart without matching on the message.
+const (
+	CodeBadRequest           = "BAD_REQUEST"
+	CodeInvalidID            = "INVALID_ID"
+	CodeInvalidQuery         = "INVALID_QUERY"
+	CodeInvalidCursor        = "INVALID_CURSOR"
+	CodeInvalidJSON          = "INVALID_JSON"
+	CodeInvalidItem          = "INVALID_ITEM"
+	CodeInvalidImage         = "INVALID_IMAGE"
+	CodeInvalidImageName     = "INVALID_IMAGE_NAME"
+	CodeUnauthorized         = "UNAUTHORIZED"
+	CodeNotFound             = "NOT_FOUND"
+	CodeItemNotFound         = "ITEM_NOT_FOUND"
+	CodeCategoryNotFound     = "CATEGORY_NOT_FOUND"
+	CodeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	CodeConflict             = "CONFLICT"
+	CodePayloadTooLarge      = "PAYLOAD_TOO_LARGE"
+	CodeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	CodeUnprocessable        = "UNPROCESSABLE_ENTITY"
+	CodeRateLimited          = "RATE_LIMITED"
+	CodeInternal             = "INTERNAL"
+	CodeUnavailable          = "UNAVAILABLE"
+)
+
+// statusCodes gives the code of errors that come with a status only, such
+// as echo's own for unknown routes.
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            CodeBadRequest,
+	http.StatusUnauthorized:          CodeUnauthorized,
+	http.StatusNotFound:              CodeNotFound,
+	http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+	http.StatusConflict:              CodeConflict,
+	http.StatusRequestEntityTooLarge: CodePayloadTooLarge,
+	http.StatusUnsupportedMediaType:  CodeUnsupportedMediaType,
+	http.StatusUnprocessableEntity:   CodeUnprocessable,
+	http.StatusTooManyRequests:       CodeRateLimited,
+	http.StatusServiceUnavailable:    CodeUnavailable,
+}
+
+// ErrorResponse is the body of every error response.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+}
+
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiError is an error answered with its status and an ErrorResponse.
+// Handlers and middleware return it and httpErrorHandler writes it.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func newAPIError(status int, code, message string) *apiError {
+	return &apiError{status: status, code: code, message: message}
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+// httpErrorHandler answers the errors returned by handlers and
+// middleware, ours and echo's, with an ErrorResponse. Any other error is
+// a bug, logged and answered with 500.
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+	var ae *apiError
+	var he *echo.HTTPError
+	switch {
+	case errors.As(err, &ae):
+	case errors.As(err, &he):
+		ae = newAPIError(he.Code, statusCodes[he.Code], http.StatusText(he.Code))
+		if msg, ok := he.Message.(string); ok {
+			ae.message = msg
+		}
+		if ae.code == "" {
+			ae.code = CodeInternal
+			if he.Code < 500 {
+				ae.code = CodeBadRequest
+			}
+		}
+		if he.Internal != nil {
+			c.Logger().Debugf("%s: %s", ae.message, he.Internal)
+		}
+	default:
+		c.Logger().Errorf("Unhandled error: %s", err)
+		ae = newAPIError(http.StatusInternalServerError, CodeInternal, "Internal server error")
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(ae.status)
+	} else {
+		err = c.JSON(ae.status, ErrorResponse{Error: ErrorBody{Code: ae.code, Message: ae.message}})
+	}
+	if err != nil {
+		c.Logger().Errorf("Error while writing error response: %s", err)
+	}
+}
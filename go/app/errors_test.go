@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestErrorEnvelope checks the exact body of an error of each handler
+// and of echo's own errors, all of which must be an ErrorResponse.
+func TestErrorEnvelope(t *testing.T) {
+	tests := []struct {
+		name       string
+		req        func() *http.Request
+		failing    bool
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name: "addItem content type", req: func() *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/items", strings.NewReader("name=cap"))
+			},
+			wantStatus: http.StatusUnsupportedMediaType,
+			wantBody:   `{"error":{"code":"UNSUPPORTED_MEDIA_TYPE","message":"Content-Type must be multipart/form-data, application/x-www-form-urlencoded or application/json"}}`,
+		},
+		{
+			name: "addItem invalid", req: form(http.MethodPost, "/items", "category", "fashion"),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"code":"INVALID_ITEM","message":"name is required"}}`,
+		},
+		{
+			name: "addItem db error", req: form(http.MethodPost, "/items", "name", "cap", "category", "fashion"), failing: true,
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   `{"error":{"code":"INTERNAL","message":"Error while saving item"}}`,
+		},
+		{
+			name: "getInfoById malformed", req: get("/items/abc"),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"code":"INVALID_ID","message":"Item id must be an integer"}}`,
+		},
+		{
+			name: "getInfoById missing", req: get("/items/99"),
+			wantStatus: http.StatusNotFound,
+			wantBody:   `{"error":{"code":"ITEM_NOT_FOUND","message":"Item not found"}}`,
+		},
+		{
+			name: "getSearch without keyword", req: get("/search"),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"code":"INVALID_QUERY","message":"keyword is required"}}`,
+		},
+		{
+			name: "postSearch unknown filter", req: jsonBody(http.MethodPost, "/search", `{"filters":{"all":[{"color":"red"}]}}`),
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   `{"error":{"code":"UNPROCESSABLE_ENTITY","message":"unknown filter \"color\""}}`,
+		},
+		{
+			name: "getImg traversal", req: get("/image/..%2Fsecret.jpg"),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"code":"INVALID_IMAGE_NAME","message":"Invalid image file name"}}`,
+		},
+		{
+			name: "getImg extension", req: get("/image/notes.txt"),
+			wantStatus: http.StatusBadRequest,
+			wantBody:   `{"error":{"code":"INVALID_IMAGE_NAME","message":"Image path does not end with .jpg, .png, .gif or .webp"}}`,
+		},
+		{
+			name: "unknown route", req: get("/nope"),
+			wantStatus: http.StatusNotFound,
+			wantBody:   `{"error":{"code":"NOT_FOUND","message":"Not Found"}}`,
+		},
+		{
+			name: "method not allowed", req: form(http.MethodPatch, "/items"),
+			wantStatus: http.StatusMethodNotAllowed,
+			wantBody:   `{"error":{"code":"METHOD_NOT_ALLOWED","message":"Method Not Allowed"}}`,
+		},
+		{
+			name: "body limit", req: form(http.MethodPost, "/items", "name", strings.Repeat("x", 100), "category", "fashion"),
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantBody:   `{"error":{"code":"PAYLOAD_TOO_LARGE","message":"Request body is larger than the limit of 64B"}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.BodyLimit = 64
+			repo := seedFake()
+			e := newTestServer(t, cfg, repo)
+			repo.failing = tt.failing
+
+			rec := serve(e, tt.req())
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := strings.TrimSuffix(rec.Body.String(), "\n"); got != tt.wantBody {
+				t.Errorf("body = %s, want %s", got, tt.wantBody)
+			}
+			// The envelope has the error object only, with a code and a
+			// message.
+			var envelope map[string]map[string]interface{}
+			if err := json.Unmarshal(rec.Body.Bytes(), &envelope); err != nil {
+				t.Fatalf("body is not an error envelope: %s", err)
+			}
+			body := envelope["error"]
+			_, hasCode := body["code"]
+			_, hasMessage := body["message"]
+			if len(envelope) != 1 || len(body) != 2 || !hasCode || !hasMessage {
+				t.Errorf("envelope = %v, want only error.code and error.message", envelope)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// errFakeDB is what fakeRepository returns once failing is set.
+var errFakeDB = errors.New("fake database failure")
+
+// fakeRepository is an in-memory ItemRepository for handler tests. It
+// keeps items in id order and only implements the filters the handler
+// tests rely on. While failing is set every call returns errFakeDB.
+type fakeRepository struct {
+	mu         sync.Mutex
+	failing    bool
+	items      []Item
+	categories []Category
+}
+
+func (r *fakeRepository) fail() error {
+	if r.failing {
+		return errFakeDB
+	}
+	return nil
+}
+
+// category returns the category called name, creating it if needed. The
+// caller holds r.mu.
+func (r *fakeRepository) category(name string) Category {
+	name = normalizeCategory(name)
+	for _, c := range r.categories {
+		if c.Name == name {
+			return c
+		}
+	}
+	c := Category{ID: int64(len(r.categories) + 1), Name: name}
+	r.categories = append(r.categories, c)
+	return c
+}
+
+func (r *fakeRepository) index(id int64) int {
+	for i, item := range r.items {
+		if item.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *fakeRepository) save(item Item) Item {
+	item.ID = 1
+	if n := len(r.items); n > 0 {
+		item.ID = r.items[n-1].ID + 1
+	}
+	item.Category = r.category(item.Category).Name
+	item.CreatedAt = timestamp()
+	item.UpdatedAt = item.CreatedAt
+	r.items = append(r.items, item)
+	return item
+}
+
+func (r *fakeRepository) SaveItem(_ context.Context, item Item) (Item, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return Item{}, err
+	}
+	return r.save(item), nil
+}
+
+func (r *fakeRepository) SaveItems(_ context.Context, items []Item) ([]Item, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return nil, err
+	}
+	saved := make([]Item, len(items))
+	for i, item := range items {
+		saved[i] = r.save(item)
+	}
+	return saved, nil
+}
+
+// list returns the items passing opts and match, ignoring opts.Sort and
+// the price range. The caller holds r.mu.
+func (r *fakeRepository) list(opts ListOptions, match func(Item) bool) ItemsPage {
+	page := ItemsPage{Items: Items{Items: []Item{}}}
+	for _, item := range r.items {
+		if !opts.Deleted.matches(item.DeletedAt) || item.ID <= opts.After || !match(item) {
+			continue
+		}
+		if opts.Category != "" && item.Category != normalizeCategory(opts.Category) {
+			continue
+		}
+		page.Total++
+		if page.Total <= opts.Offset || (opts.Limit > 0 && len(page.Items.Items) == opts.Limit) {
+			continue
+		}
+		page.Items.Items = append(page.Items.Items, item)
+	}
+	return page
+}
+
+func (r *fakeRepository) ReadItems(_ context.Context, opts ListOptions) (ItemsPage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return ItemsPage{}, err
+	}
+	return r.list(opts, func(Item) bool { return true }), nil
+}
+
+func (r *fakeRepository) SearchItems(_ context.Context, keywords string, opts ListOptions) (ItemsPage, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return ItemsPage{}, err
+	}
+	return r.list(opts, searchMatch(keywords, ListOptions{})), nil
+}
+
+func (r *fakeRepository) QueryItems(_ context.Context, req SearchRequest) (Items, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return Items{}, err
+	}
+	page := r.list(ListOptions{Page: Page{Limit: req.Limit}}, func(item Item) bool {
+		return req.Keyword == "" || keywordMatch(item, req.Keyword)
+	})
+	return page.Items, nil
+}
+
+func (r *fakeRepository) EachItem(ctx context.Context, opts ListOptions, fn func(Item) error) error {
+	r.mu.Lock()
+	if err := r.fail(); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	opts.Page = Page{}
+	page := r.list(opts, func(Item) bool { return true })
+	r.mu.Unlock()
+	for _, item := range page.Items.Items {
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *fakeRepository) GetItem(_ context.Context, id int64) (Item, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return Item{}, err
+	}
+	i := r.index(id)
+	if i < 0 || r.items[i].DeletedAt != "" {
+		return Item{}, ErrItemNotFound
+	}
+	return r.items[i], nil
+}
+
+func (r *fakeRepository) TrashItem(_ context.Context, id int64) (Item, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return Item{}, err
+	}
+	i := r.index(id)
+	if i < 0 || r.items[i].DeletedAt != "" {
+		return Item{}, ErrItemNotFound
+	}
+	r.items[i].DeletedAt = timestamp()
+	return r.items[i], nil
+}
+
+func (r *fakeRepository) RestoreItem(_ context.Context, id int64) (Item, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return Item{}, err
+	}
+	i := r.index(id)
+	if i < 0 || r.items[i].DeletedAt == "" {
+		return Item{}, ErrItemNotFound
+	}
+	r.items[i].DeletedAt = ""
+	return r.items[i], nil
+}
+
+func (r *fakeRepository) UpdateItem(_ context.Context, id int64, name, category, imageName string, price int64) (string, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return "", false, err
+	}
+	i := r.index(id)
+	if i < 0 || r.items[i].DeletedAt != "" {
+		return "", false, ErrItemNotFound
+	}
+	oldImage := r.items[i].ImageName
+	if imageName == "" {
+		imageName = oldImage
+	}
+	r.items[i].Name, r.items[i].Category, r.items[i].ImageName, r.items[i].Price = name, r.category(category).Name, imageName, price
+	r.items[i].UpdatedAt = timestamp()
+	return oldImage, false, nil
+}
+
+func (r *fakeRepository) DeleteItem(_ context.Context, id int64) (Item, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return Item{}, false, err
+	}
+	i := r.index(id)
+	if i < 0 {
+		return Item{}, false, ErrItemNotFound
+	}
+	item := r.items[i]
+	r.items = append(r.items[:i], r.items[i+1:]...)
+	return item, false, nil
+}
+
+func (r *fakeRepository) ImageNames(_ context.Context) (map[string]bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, item := range r.items {
+		if item.ImageName != "" {
+			names[item.ImageName] = true
+		}
+	}
+	return names, nil
+}
+
+func (r *fakeRepository) ImportItems(_ context.Context, items []Item) ([]bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return nil, err
+	}
+	inserted := make([]bool, len(items))
+	for i, item := range items {
+		r.save(item)
+		inserted[i] = true
+	}
+	return inserted, nil
+}
+
+func (r *fakeRepository) CheckCategoryId(_ context.Context, name string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return 0, err
+	}
+	return r.category(name).ID, nil
+}
+
+func (r *fakeRepository) CountItems(_ context.Context, keywords string, opts ListOptions) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return 0, err
+	}
+	return r.list(opts, searchMatch(keywords, ListOptions{})).Total, nil
+}
+
+func (r *fakeRepository) ReadCategories(_ context.Context, keywords string, opts ListOptions) (Categories, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return Categories{}, err
+	}
+	categories := Categories{Categories: []CategoryCount{}}
+	for _, c := range r.categories {
+		opts.Category = c.Name
+		categories.Categories = append(categories.Categories, CategoryCount{Category: c, ItemCount: r.list(opts, searchMatch(keywords, ListOptions{})).Total})
+	}
+	sort.Slice(categories.Categories, func(i, j int) bool {
+		return categories.Categories[i].Name < categories.Categories[j].Name
+	})
+	return categories, nil
+}
+
+// categoryIndex returns the index of the category with the id, or -1. The
+// caller holds r.mu.
+func (r *fakeRepository) categoryIndex(id int64) int {
+	for i, c := range r.categories {
+		if c.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *fakeRepository) GetCategory(_ context.Context, id int64) (Category, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return Category{}, err
+	}
+	i := r.categoryIndex(id)
+	if i < 0 {
+		return Category{}, errCategoryNotFound
+	}
+	return r.categories[i], nil
+}
+
+func (r *fakeRepository) RenameCategory(_ context.Context, id int64, name string) (Category, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return Category{}, err
+	}
+	i := r.categoryIndex(id)
+	if i < 0 {
+		return Category{}, errCategoryNotFound
+	}
+	for _, c := range r.categories {
+		if c.Name == name && c.ID != id {
+			return Category{}, errCategoryExists
+		}
+	}
+	old := r.categories[i].Name
+	r.categories[i].Name = name
+	for j := range r.items {
+		if r.items[j].Category == old {
+			r.items[j].Category = name
+		}
+	}
+	return r.categories[i], nil
+}
+
+func (r *fakeRepository) MergeCategory(_ context.Context, fromId, toId int64) (CategoryMerge, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.fail(); err != nil {
+		return CategoryMerge{}, err
+	}
+	if fromId == toId {
+		return CategoryMerge{}, errSameCategory
+	}
+	from, to := r.categoryIndex(fromId), r.categoryIndex(toId)
+	if from < 0 || to < 0 {
+		return CategoryMerge{}, errCategoryNotFound
+	}
+	res := CategoryMerge{Category: r.categories[to]}
+	for j := range r.items {
+		if r.items[j].Category == r.categories[from].Name {
+			r.items[j].Category = res.Name
+			res.MovedItems++
+		}
+	}
+	r.categories = append(r.categories[:from], r.categories[from+1:]...)
+	return res, nil
+}
+
+func (r *fakeRepository) Ping(context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.fail()
+}
+
+func (r *fakeRepository) Close() error {
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// hashedAssetCache is used for the build's fingerprinted assets under
+	// static/, whose names change whenever their contents do.
+	hashedAssetCache = "public, max-age=31536000, immutable"
+	// entryCache makes browsers revalidate index.html and other unhashed
+	// files so a new deployment is picked up immediately.
+	entryCache = "no-cache"
+)
+
+// frontend serves the embedded single-page app. Paths that do not match a
+// file fall back to index.html so that client-side routing works, except
+// under the API prefixes, which keep answering with a JSON 404.
+type frontend struct {
+	fsys        fs.FS
+	apiPrefixes []string
+	modTime     time.Time
+}
+
+var errNoFrontend = errors.New("frontend build not found")
+
+func newFrontend(fsys fs.FS) (*frontend, error) {
+	if fsys == nil {
+		return nil, errNoFrontend
+	}
+	if _, err := fs.Stat(fsys, "index.html"); err != nil {
+		return nil, errNoFrontend
+	}
+	// embed.FS reports a zero modification time, so use the start-up time
+	// for Last-Modified instead.
+	return &frontend{fsys: fsys, modTime: time.Now()}, nil
+}
+
+// setAPIRoutes records the first path segment of every registered route so
+// the SPA fallback never shadows an API path.
+func (f *frontend) setAPIRoutes(routes []*echo.Route) {
+	seen := map[string]bool{}
+	for _, r := range routes {
+		seg := strings.SplitN(strings.TrimPrefix(r.Path, "/"), "/", 2)[0]
+		if seg == "" || seg == "*" || seen[seg] {
+			continue
+		}
+		seen[seg] = true
+		f.apiPrefixes = append(f.apiPrefixes, "/"+seg)
+	}
+}
+
+func (f *frontend) isAPIPath(p string) bool {
+	for _, prefix := range f.apiPrefixes {
+		if p == prefix || strings.HasPrefix(p, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *frontend) serve(c echo.Context) error {
+	reqPath := path.Clean("/" + c.Request().URL.Path)
+	if f.isAPIPath(reqPath) {
+		return echo.ErrNotFound
+	}
+
+	name := strings.TrimPrefix(reqPath, "/")
+	if name == "" {
+		name = "index.html"
+	}
+	if info, err := fs.Stat(f.fsys, name); err != nil || info.IsDir() {
+		// A missing fingerprinted asset is a real 404; serving index.html
+		// in its place would only confuse the browser.
+		if strings.HasPrefix(name, "static/") {
+			return echo.ErrNotFound
+		}
+		name = "index.html"
+	}
+
+	if strings.HasPrefix(name, "static/") {
+		c.Response().Header().Set("Cache-Control", hashedAssetCache)
+	} else {
+		c.Response().Header().Set("Cache-Control", entryCache)
+	}
+	return f.serveFile(c, name)
+}
+
+func (f *frontend) serveFile(c echo.Context, name string) error {
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		return errors.New("embedded file is not seekable: " + name)
+	}
+	// ServeContent picks the Content-Type from the extension and handles
+	// conditional and range requests.
+	http.ServeContent(c.Response(), c.Request(), name, f.modTime, content)
+	return nil
+}
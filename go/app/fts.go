@@ -0,0 +1,118 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ftsMinTerm is the shortest search term the trigram index can match.
+// Shorter terms are matched with LIKE instead.
+const ftsMinTerm = 3
+
+// ftsSchema is the full-text index over item and category names. It is
+// kept out of the schema file because go-sqlite3 only has FTS5 when built
+// with the sqlite_fts5 tag. The trigram tokenizer matches substrings, so
+// Japanese names, which have no spaces between words, are still found
+// from part of a name as with LIKE.
+var ftsSchema = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS items_fts USING fts5 (name, category, tokenize = 'trigram')`,
+	`CREATE TRIGGER IF NOT EXISTS items_fts_insert AFTER INSERT ON items BEGIN
+		INSERT INTO items_fts (rowid, name, category)
+		VALUES (new.id, new.name, (SELECT name FROM categories WHERE id = new.category_id));
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS items_fts_update AFTER UPDATE OF name, category_id ON items BEGIN
+		UPDATE items_fts SET name = new.name, category = (SELECT name FROM categories WHERE id = new.category_id)
+		WHERE rowid = new.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS items_fts_delete AFTER DELETE ON items BEGIN
+		DELETE FROM items_fts WHERE rowid = old.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS items_fts_category AFTER UPDATE OF name ON categories BEGIN
+		UPDATE items_fts SET category = new.name WHERE rowid IN (SELECT id FROM items WHERE category_id = new.id);
+	END`,
+}
+
+var ftsTriggers = []string{"items_fts_insert", "items_fts_update", "items_fts_delete", "items_fts_category"}
+
+// setupFTS creates the full-text index and reports whether searches can
+// use it. Without FTS5 it drops the triggers a build with FTS5 may have
+// left, since they would make every write to items fail, and searches
+// keep using LIKE.
+func setupFTS(db *sql.DB) (bool, error) {
+	var triggers int
+	if err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'items_fts_%'").Scan(&triggers); err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// The index may exist from another build, so probe with a scratch
+	// table rather than relying on CREATE failing.
+	if _, err := tx.Exec("CREATE VIRTUAL TABLE temp.fts_probe USING fts5 (x, tokenize = 'trigram')"); err != nil {
+		if !strings.Contains(err.Error(), "no such module") && !strings.Contains(err.Error(), "no such tokenizer") {
+			return false, fmt.Errorf("checking for FTS5: %w", err)
+		}
+		for _, name := range ftsTriggers {
+			if _, err := tx.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+				return false, err
+			}
+		}
+		return false, tx.Commit()
+	}
+	if _, err := tx.Exec("DROP TABLE temp.fts_probe"); err != nil {
+		return false, err
+	}
+	for _, stmt := range ftsSchema {
+		if _, err := tx.Exec(stmt); err != nil {
+			return false, fmt.Errorf("creating the search index: %w", err)
+		}
+	}
+	// A new index, or one a build without FTS5 stopped maintaining, is
+	// filled from scratch.
+	if triggers < len(ftsTriggers) {
+		if _, err := tx.Exec("DELETE FROM items_fts"); err != nil {
+			return false, err
+		}
+		if _, err := tx.Exec(`INSERT INTO items_fts (rowid, name, category)
+			SELECT items.id, items.name, categories.name FROM items JOIN categories ON items.category_id = categories.id`); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+// addFullText matches every whitespace-separated term of keyword against
+// the item or category name, in any order, and makes the query rankable with
+// ftsOrder. It reports false if no term was long enough for the index, in
+// which case the terms were added as LIKE conditions only.
+func (q *itemQuery) addFullText(keyword string) bool {
+	var phrases []string
+	for _, term := range strings.Fields(keyword) {
+		if utf8.RuneCountInString(term) < ftsMinTerm {
+			q.addKeyword(term)
+			continue
+		}
+		phrases = append(phrases, ftsPhrase(term))
+	}
+	if len(phrases) == 0 {
+		return false
+	}
+	q.join = " JOIN items_fts ON items_fts.rowid = items.id"
+	q.add("items_fts MATCH ?", strings.Join(phrases, " AND "))
+	return true
+}
+
+// ftsOrder ranks full-text matches, best first.
+const ftsOrder = "items_fts.rank, items.id"
+
+// ftsPhrase quotes term as an FTS5 string, so that operators, column
+// filters and quotes in user input are matched literally.
+func ftsPhrase(term string) string {
+	return `"` + strings.ReplaceAll(term, `"`, `""`) + `"`
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ReadyTimeout bounds the readiness checks so a locked database fails
+// the probe instead of hanging it.
+const ReadyTimeout = time.Second
+
+type HealthResponse struct {
+	Status string `json:"status"`
+	// Checks maps each readiness check to "ok" or the reason it failed.
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// healthz is the liveness probe: the process is up and serving.
+func healthz(c echo.Context) error {
+	return c.JSON(http.StatusOK, HealthResponse{Status: "ok"})
+}
+
+// readyz is the readiness probe: the storage answers and images can be
+// written.
+func (s ServerImpl) readyz(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), ReadyTimeout)
+	defer cancel()
+
+	res := HealthResponse{Status: "ok", Checks: map[string]string{"storage": "ok", "images": "ok"}}
+	if err := s.repo.Ping(ctx); err != nil {
+		res.Status, res.Checks["storage"] = "unavailable", err.Error()
+	}
+	if err := checkWritable(s.imgDir); err != nil {
+		res.Status, res.Checks["images"] = "unavailable", err.Error()
+	}
+	if res.Status != "ok" {
+		c.Logger().Warnf("Readiness check failed: %v", res.Checks)
+		return c.JSON(http.StatusServiceUnavailable, res)
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// checkWritable creates and removes a file in dir.
+func checkWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ImageGCGrace spares files younger than this from the image GC. addItem
+// stores the image before the row referencing it, so a young file may
+// belong to an item that is still being saved.
+const ImageGCGrace = 10 * time.Minute
+
+// ImageGCResult is the body of POST /admin/images/gc.
+type ImageGCResult struct {
+	DryRun bool `json:"dry_run"`
+	// Removed lists the files removed, or that would be with dry_run.
+	Removed        []string `json:"removed"`
+	RemovedCount   int      `json:"removed_count"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+	// Spared counts the unreferenced files kept for being too young.
+	Spared int `json:"spared"`
+}
+
+// storedHash returns the sha256 a file in the images directory is stored
+// under, for images and their renditions alike. It returns "" for
+// anything else, such as default.jpg, which the GC leaves alone.
+func storedHash(name string) string {
+	if isImageName(name) {
+		return strings.TrimSuffix(name, path.Ext(name))
+	}
+	if hash, ok := strings.CutSuffix(name, "_thumb.jpg"); ok && isImageName(hash+".jpg") {
+		return hash
+	}
+	return ""
+}
+
+// collectImages removes the stored images, renditions and resized
+// images no item references that were last modified before cutoff. With
+// dryRun it only reports them.
+func collectImages(imgDir string, referenced map[string]bool, cutoff time.Time, dryRun bool, logger echo.Logger) (ImageGCResult, error) {
+	// Files are kept by hash, so that the renditions of a referenced
+	// image survive with it.
+	keep := map[string]bool{}
+	for name := range referenced {
+		keep[storedHash(name)] = true
+	}
+
+	res := ImageGCResult{DryRun: dryRun, Removed: []string{}}
+	if err := collectDir(imgDir, "", storedHash, keep, cutoff, dryRun, logger, &res); err != nil {
+		return ImageGCResult{}, err
+	}
+	err := collectDir(imgDir, ResizeCacheDir, resizedHash, keep, cutoff, dryRun, logger, &res)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return ImageGCResult{}, err
+	}
+	sort.Strings(res.Removed)
+	res.RemovedCount = len(res.Removed)
+	return res, nil
+}
+
+// collectDir collects the files of the subdirectory dir of imgDir, whose
+// hashes hashOf tells, into res. Removed files are listed relative to
+// imgDir.
+func collectDir(imgDir, dir string, hashOf func(string) string, keep map[string]bool, cutoff time.Time, dryRun bool, logger echo.Logger, res *ImageGCResult) error {
+	entries, err := os.ReadDir(path.Join(imgDir, dir))
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		hash := hashOf(e.Name())
+		if !e.Type().IsRegular() || hash == "" || keep[hash] {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			// Removed since the directory was read.
+			continue
+		}
+		if !fi.ModTime().Before(cutoff) {
+			res.Spared++
+			continue
+		}
+		name := path.Join(dir, e.Name())
+		if !dryRun {
+			if err := os.Remove(path.Join(imgDir, name)); err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					logger.Errorf("Error while removing image %s: %s", name, err)
+				}
+				continue
+			}
+		}
+		res.Removed = append(res.Removed, name)
+		res.ReclaimedBytes += fi.Size()
+	}
+	return nil
+}
+
+// gcImages implements POST /admin/images/gc. ?dry_run=true reports what
+// would be removed without removing it.
+func (s ServerImpl) gcImages(c echo.Context) error {
+	dryRun := false
+	if v := c.QueryParam("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			return newAPIError(http.StatusBadRequest, CodeInvalidQuery, "dry_run must be true or false")
+		}
+	}
+
+	cutoff := time.Now().Add(-ImageGCGrace)
+	referenced, err := s.repo.ImageNames(c.Request().Context())
+	if err != nil {
+		c.Logger().Errorf("Error while reading image names: %s", err)
+		return dbError(err, "Error while reading image names")
+	}
+	res, err := collectImages(s.imgDir, referenced, cutoff, dryRun, c.Logger())
+	if err != nil {
+		c.Logger().Errorf("Error while collecting images: %s", err)
+		return newAPIError(http.StatusInternalServerError, CodeInternal, "Error while reading the images directory")
+	}
+	if !dryRun {
+		c.Logger().Infof("Image GC removed %d files, %d bytes", res.RemovedCount, res.ReclaimedBytes)
+	}
+	return c.JSON(http.StatusOK, res)
+}
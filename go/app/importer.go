@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/labstack/echo/v4"
+)
+
+// legacyItems is the items.json format from the STEP3 exercises.
+type legacyItems struct {
+	Items []Item `json:"items"`
+}
+
+type ImportEntry struct {
+	Index     int    `json:"index"`
+	Name      string `json:"name"`
+	ImageName string `json:"image_name,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type ImportSummary struct {
+	Imported      []ImportEntry `json:"imported"`
+	Skipped       []ImportEntry `json:"skipped"`
+	MissingImages []ImportEntry `json:"missing_images"`
+}
+
+// importItemsJSON imports the items.json document read from src. Items
+// are validated like POST /items does and invalid ones are skipped. Images
+// referenced by the items are copied from oldImgDir into imgDir when they
+// are not there yet; oldImgDir may be empty to only check imgDir.
+//
+// All items are inserted in one transaction. Items already present with
+// the same name, category and image are skipped, so re-running an import
+// is a no-op.
+func importItemsJSON(ctx context.Context, repo ItemRepository, imgDir string, src io.Reader, oldImgDir string) (ImportSummary, error) {
+	var doc legacyItems
+	if err := json.NewDecoder(src).Decode(&doc); err != nil {
+		return ImportSummary{}, fmt.Errorf("%w: %s", errInvalidItemsJSON, err)
+	}
+
+	summary := ImportSummary{
+		Imported:      []ImportEntry{},
+		Skipped:       []ImportEntry{},
+		MissingImages: []ImportEntry{},
+	}
+	// indexes maps the valid items back to their index in the document.
+	var items []Item
+	var indexes []int
+	for i, item := range doc.Items {
+		valid, err := addItemRequest{Name: item.Name, Category: item.Category, Price: item.Price}.item()
+		if err != nil {
+			summary.Skipped = append(summary.Skipped, ImportEntry{Index: i, Name: item.Name, ImageName: item.ImageName, Reason: err.Error()})
+			continue
+		}
+		valid.ImageName = item.ImageName
+		if item.ImageName != "" {
+			stored, err := importImage(imgDir, item.ImageName, oldImgDir)
+			if err != nil {
+				summary.MissingImages = append(summary.MissingImages, ImportEntry{Index: i, Name: valid.Name, ImageName: item.ImageName, Reason: err.Error()})
+			} else {
+				valid.ImageName = stored
+			}
+		}
+		items = append(items, valid)
+		indexes = append(indexes, i)
+	}
+
+	inserted, err := repo.ImportItems(ctx, items)
+	if err != nil {
+		return ImportSummary{}, err
+	}
+	for j, item := range items {
+		entry := ImportEntry{Index: indexes[j], Name: item.Name, ImageName: item.ImageName}
+		if inserted[j] {
+			summary.Imported = append(summary.Imported, entry)
+		} else {
+			entry.Reason = "duplicate"
+			summary.Skipped = append(summary.Skipped, entry)
+		}
+	}
+	return summary, nil
+}
+
+var (
+	errInvalidItemsJSON = errors.New("invalid items.json")
+	errImageNotFound    = errors.New("image not found")
+)
+
+// importImage makes sure the image called name is present in imgDir,
+// copying it from oldImgDir if needed, and returns its stored name. The
+// copied contents must hash to the name; the extension is the one of the
+// actual format, as legacy images were all named .jpg.
+func importImage(imgDir, name, oldImgDir string) (string, error) {
+	if !isImageName(name) {
+		return "", errors.New("image_name is not a sha256 file name")
+	}
+	if _, err := os.Stat(path.Join(imgDir, name)); err == nil {
+		return name, nil
+	}
+	if oldImgDir == "" {
+		return "", errImageNotFound
+	}
+
+	f, err := os.Open(filepath.Join(oldImgDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", errImageNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	sum, err := fileSHA256(f.Name())
+	if err != nil {
+		return "", err
+	}
+	if fmt.Sprintf("%x", sum)+path.Ext(name) != name {
+		return "", errors.New("image contents do not match its sha256 name")
+	}
+	return saveImage(imgDir, f, 0)
+}
+
+// importItems implements POST /admin/import/items-json. Images are only
+// looked up in the image directory: copying them from elsewhere is left to
+// --import-images, as a request must not name paths on the server.
+func (s ServerImpl) importItems(c echo.Context) error {
+	summary, err := importItemsJSON(c.Request().Context(), s.repo, s.imgDir, c.Request().Body, "")
+	s.cache.invalidate()
+	if err != nil {
+		if errors.Is(err, errInvalidItemsJSON) {
+			return newAPIError(http.StatusBadRequest, CodeInvalidJSON, err.Error())
+		}
+		c.Logger().Errorf("Error while importing items: %s", err)
+		return dbError(err, "Error while importing items")
+	}
+	c.Logger().Infof("Imported %d items, skipped %d, %d missing images", len(summary.Imported), len(summary.Skipped), len(summary.MissingImages))
+	return c.JSON(http.StatusOK, summary)
+}
+
+// runImport implements the --import-json flag.
+func runImport(repo ItemRepository, imgDir, jsonPath, oldImgDir string) error {
+	f, err := os.Open(jsonPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	summary, err := importItemsJSON(context.Background(), repo, imgDir, f, oldImgDir)
+	if err != nil {
+		return err
+	}
+	out, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type jsonCategory struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type jsonItem struct {
+	ID         int64  `json:"id"`
+	Name       string `json:"name"`
+	CategoryID int64  `json:"category_id"`
+	ImageName  string `json:"image_name,omitempty"`
+	Price      int64  `json:"price,omitempty"`
+	CreatedAt  string `json:"created_at,omitempty"`
+	UpdatedAt  string `json:"updated_at,omitempty"`
+	DeletedAt  string `json:"deleted_at,omitempty"`
+}
+
+type jsonData struct {
+	Items      []jsonItem     `json:"items"`
+	Categories []jsonCategory `json:"categories"`
+}
+
+// jsonRepository is an ItemRepository persisted to a single JSON file, for
+// builds without cgo. The whole file is rewritten atomically on every
+// mutation; reads are served from memory. Nothing it does can stall on
+// I/O for long, so it ignores the contexts it is given.
+type jsonRepository struct {
+	mu   sync.RWMutex
+	path string
+	data jsonData
+
+	// Indexes into data, rebuilt on load and kept up to date on writes.
+	itemIndex     map[int64]int
+	categoryNames map[int64]string
+}
+
+var _ ItemRepository = (*jsonRepository)(nil)
+
+func newJSONRepository(path string) (*jsonRepository, error) {
+	r := &jsonRepository{path: path}
+	b, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(b, &r.data); err != nil {
+			return nil, err
+		}
+	}
+	r.reindex()
+	return r, nil
+}
+
+func (r *jsonRepository) reindex() {
+	r.itemIndex = make(map[int64]int, len(r.data.Items))
+	for i, item := range r.data.Items {
+		r.itemIndex[item.ID] = i
+	}
+	r.categoryNames = make(map[int64]string, len(r.data.Categories))
+	for _, c := range r.data.Categories {
+		r.categoryNames[c.ID] = c.Name
+	}
+}
+
+// persist writes data to a temporary file next to path and renames it into
+// place, so readers of the file never see a partial write.
+func (r *jsonRepository) persist(data jsonData) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(r.path), filepath.Base(r.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), r.path)
+}
+
+// commit persists next and, only once that succeeded, makes it the
+// in-memory state. The caller must hold the write lock.
+func (r *jsonRepository) commit(next jsonData) error {
+	if err := r.persist(next); err != nil {
+		return err
+	}
+	r.data = next
+	r.reindex()
+	return nil
+}
+
+// Ping checks that the directory holding the file is still writable,
+// since every mutation writes a new file there.
+func (r *jsonRepository) Ping(_ context.Context) error {
+	return checkWritable(filepath.Dir(r.path))
+}
+
+func (r *jsonRepository) Close() error {
+	return nil
+}
+
+// withCategory finds or adds the category, returning the data to commit.
+func (data jsonData) withCategory(name string) (jsonData, int64) {
+	name = normalizeCategory(name)
+	var id int64 = 1
+	for _, c := range data.Categories {
+		if c.Name == name {
+			return data, c.ID
+		}
+		if c.ID >= id {
+			id = c.ID + 1
+		}
+	}
+	// Cap the slice so append copies instead of writing into r.data,
+	// which must stay untouched until the new state is persisted.
+	data.Categories = append(data.Categories[:len(data.Categories):len(data.Categories)], jsonCategory{ID: id, Name: name})
+	return data, id
+}
+
+func (r *jsonRepository) CheckCategoryId(_ context.Context, name string) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, id := r.data.withCategory(name)
+	if len(next.Categories) == len(r.data.Categories) {
+		return id, nil
+	}
+	return id, r.commit(next)
+}
+
+func (r *jsonRepository) ReadCategories(_ context.Context, keywords string, opts ListOptions) (Categories, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	opts.Category = ""
+	counts := r.countByCategory(opts.Deleted, searchMatch(keywords, opts))
+	categories := Categories{Categories: make([]CategoryCount, 0, len(r.data.Categories))}
+	for _, c := range r.data.Categories {
+		categories.Categories = append(categories.Categories, CategoryCount{Category: Category{ID: c.ID, Name: c.Name}, ItemCount: counts[c.ID]})
+	}
+	sort.Slice(categories.Categories, func(i, j int) bool {
+		a, b := categories.Categories[i], categories.Categories[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+	return categories, nil
+}
+
+func (r *jsonRepository) GetCategory(_ context.Context, id int64) (Category, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	name, ok := r.categoryNames[id]
+	if !ok {
+		return Category{}, errCategoryNotFound
+	}
+	return Category{ID: id, Name: name}, nil
+}
+
+func (r *jsonRepository) RenameCategory(_ context.Context, id int64, name string) (Category, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old, ok := r.categoryNames[id]
+	if !ok {
+		return Category{}, errCategoryNotFound
+	}
+	if old == name {
+		return Category{ID: id, Name: name}, nil
+	}
+	next := r.data
+	next.Categories = make([]jsonCategory, len(r.data.Categories))
+	for i, c := range r.data.Categories {
+		if c.Name == name {
+			return Category{}, errCategoryExists
+		}
+		if c.ID == id {
+			c.Name = name
+		}
+		next.Categories[i] = c
+	}
+	return Category{ID: id, Name: name}, r.commit(next)
+}
+
+func (r *jsonRepository) MergeCategory(_ context.Context, fromId, toId int64) (CategoryMerge, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if fromId == toId {
+		return CategoryMerge{}, errSameCategory
+	}
+	if _, ok := r.categoryNames[fromId]; !ok {
+		return CategoryMerge{}, errCategoryNotFound
+	}
+	name, ok := r.categoryNames[toId]
+	if !ok {
+		return CategoryMerge{}, errCategoryNotFound
+	}
+
+	res := CategoryMerge{Category: Category{ID: toId, Name: name}}
+	next := r.data
+	next.Items = append([]jsonItem(nil), r.data.Items...)
+	for i := range next.Items {
+		if next.Items[i].CategoryID == fromId {
+			next.Items[i].CategoryID = toId
+			res.MovedItems++
+		}
+	}
+	next.Categories = make([]jsonCategory, 0, len(r.data.Categories)-1)
+	for _, c := range r.data.Categories {
+		if c.ID != fromId {
+			next.Categories = append(next.Categories, c)
+		}
+	}
+	return res, r.commit(next)
+}
+
+func (r *jsonRepository) SaveItem(ctx context.Context, item Item) (Item, error) {
+	saved, err := r.SaveItems(ctx, []Item{item})
+	if err != nil {
+		return Item{}, err
+	}
+	return saved[0], nil
+}
+
+func (r *jsonRepository) SaveItems(_ context.Context, items []Item) ([]Item, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next := r.data
+	for _, item := range items {
+		next = next.withItem(item)
+	}
+	if err := r.commit(next); err != nil {
+		return nil, err
+	}
+	added := r.data.Items[len(r.data.Items)-len(items):]
+	saved := make([]Item, len(added))
+	for i, ji := range added {
+		saved[i] = r.item(ji)
+	}
+	return saved, nil
+}
+
+// withItem appends a new item with the fields of item that SaveItem
+// stores, returning the data to commit.
+func (data jsonData) withItem(item Item) jsonData {
+	data, categoryId := data.withCategory(item.Category)
+	var id int64 = 1
+	for _, item := range data.Items {
+		if item.ID >= id {
+			id = item.ID + 1
+		}
+	}
+	now := timestamp()
+	data.Items = append(data.Items[:len(data.Items):len(data.Items)], jsonItem{
+		ID:         id,
+		Name:       item.Name,
+		CategoryID: categoryId,
+		ImageName:  item.ImageName,
+		Price:      item.Price,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	})
+	return data
+}
+
+func (r *jsonRepository) UpdateItem(_ context.Context, id int64, name, category, imageName string, price int64) (string, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i, ok := r.itemIndex[id]
+	if !ok || r.data.Items[i].DeletedAt != "" {
+		return "", false, ErrItemNotFound
+	}
+	oldImage := r.data.Items[i].ImageName
+	if imageName == "" {
+		imageName = oldImage
+	}
+
+	next, categoryId := r.data.withCategory(category)
+	next.Items = append([]jsonItem(nil), next.Items...)
+	next.Items[i] = jsonItem{
+		ID:         id,
+		Name:       name,
+		CategoryID: categoryId,
+		ImageName:  imageName,
+		Price:      price,
+		CreatedAt:  r.data.Items[i].CreatedAt,
+		UpdatedAt:  timestamp(),
+	}
+	if err := r.commit(next); err != nil {
+		return "", false, err
+	}
+	return oldImage, r.data.imageOrphaned(oldImage), nil
+}
+
+// imageOrphaned reports whether imageName is set but no item uses it.
+func (data jsonData) imageOrphaned(imageName string) bool {
+	if imageName == "" {
+		return false
+	}
+	for _, ji := range data.Items {
+		if ji.ImageName == imageName {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *jsonRepository) DeleteItem(_ context.Context, id int64) (Item, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i, ok := r.itemIndex[id]
+	if !ok {
+		return Item{}, false, ErrItemNotFound
+	}
+	item := r.item(r.data.Items[i])
+
+	next := r.data
+	next.Items = make([]jsonItem, 0, len(r.data.Items)-1)
+	for _, ji := range r.data.Items {
+		if ji.ID != id {
+			next.Items = append(next.Items, ji)
+		}
+	}
+	if err := r.commit(next); err != nil {
+		return Item{}, false, err
+	}
+	return item, r.data.imageOrphaned(item.ImageName), nil
+}
+
+func (r *jsonRepository) ImageNames(_ context.Context) (map[string]bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := map[string]bool{}
+	for _, ji := range r.data.Items {
+		if ji.ImageName != "" {
+			names[ji.ImageName] = true
+		}
+	}
+	return names, nil
+}
+
+func (r *jsonRepository) ImportItems(_ context.Context, items []Item) ([]bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next := r.data
+	inserted := make([]bool, len(items))
+	for i, item := range items {
+		if next.contains(item) {
+			continue
+		}
+		next = next.withItem(item)
+		inserted[i] = true
+	}
+	return inserted, r.commit(next)
+}
+
+// contains reports whether data has an item equal to item, comparing the
+// category after normalization.
+func (data jsonData) contains(item Item) bool {
+	category := normalizeCategory(item.Category)
+	names := make(map[int64]string, len(data.Categories))
+	for _, c := range data.Categories {
+		names[c.ID] = c.Name
+	}
+	for _, ji := range data.Items {
+		if ji.Name == item.Name && ji.ImageName == item.ImageName && names[ji.CategoryID] == category {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *jsonRepository) item(ji jsonItem) Item {
+	return Item{
+		ID:        ji.ID,
+		Name:      ji.Name,
+		Category:  r.categoryNames[ji.CategoryID],
+		ImageName: ji.ImageName,
+		Price:     ji.Price,
+		CreatedAt: ji.CreatedAt,
+		UpdatedAt: ji.UpdatedAt,
+		DeletedAt: ji.DeletedAt,
+	}
+}
+
+// filterItems returns the items passing deleted for which match is true,
+// in the order of less (by id when nil), windowed by page, and the number
+// of matches before windowing.
+func (r *jsonRepository) filterItems(deleted DeletedFilter, match func(Item) bool, less func(a, b jsonItem) bool, page Page) (Items, int) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var rows []jsonItem
+	for _, ji := range r.data.Items {
+		if deleted.matches(ji.DeletedAt) && match(r.item(ji)) {
+			rows = append(rows, ji)
+		}
+	}
+	if less == nil {
+		less = func(a, b jsonItem) bool { return a.ID < b.ID }
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return less(rows[i], rows[j]) })
+	total := len(rows)
+	if page.After > 0 {
+		after := rows[:0]
+		for _, ji := range rows {
+			if ji.ID > page.After {
+				after = append(after, ji)
+			}
+		}
+		rows = after
+	}
+	if page.Offset >= len(rows) {
+		rows = nil
+	} else {
+		rows = rows[page.Offset:]
+	}
+	if page.Limit > 0 && len(rows) > page.Limit {
+		rows = rows[:page.Limit]
+	}
+
+	items := Items{Items: []Item{}}
+	for _, ji := range rows {
+		items.Items = append(items.Items, r.item(ji))
+	}
+	return items, total
+}
+
+// listMatch reports whether an item passes the filters of opts.
+func listMatch(opts ListOptions) func(Item) bool {
+	return func(item Item) bool {
+		return inCategory(item, opts.Category) &&
+			(opts.PriceMin == nil || item.Price >= *opts.PriceMin) &&
+			(opts.PriceMax == nil || item.Price <= *opts.PriceMax)
+	}
+}
+
+func (r *jsonRepository) ReadItems(_ context.Context, opts ListOptions) (ItemsPage, error) {
+	items, total := r.filterItems(opts.Deleted, listMatch(opts), jsonListSorts[opts.Sort], opts.Page)
+	return ItemsPage{Items: items, Total: total}, nil
+}
+
+func (r *jsonRepository) SearchItems(_ context.Context, keywords string, opts ListOptions) (ItemsPage, error) {
+	items, total := r.filterItems(opts.Deleted, searchMatch(keywords, opts), jsonListSorts[opts.Sort], opts.Page)
+	return ItemsPage{Items: items, Total: total}, nil
+}
+
+// searchMatch reports whether an item has every term of keywords in its
+// item or category name and passes the filters of opts.
+func searchMatch(keywords string, opts ListOptions) func(Item) bool {
+	terms := strings.Fields(keywords)
+	inList := listMatch(opts)
+	return func(item Item) bool {
+		for _, term := range terms {
+			if !keywordMatch(item, term) {
+				return false
+			}
+		}
+		return inList(item)
+	}
+}
+
+func (r *jsonRepository) CountItems(_ context.Context, keywords string, opts ListOptions) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n := 0
+	for _, count := range r.countByCategory(opts.Deleted, searchMatch(keywords, opts)) {
+		n += count
+	}
+	return n, nil
+}
+
+// countByCategory counts the items passing deleted and match by category
+// id. The caller holds r.mu.
+func (r *jsonRepository) countByCategory(deleted DeletedFilter, match func(Item) bool) map[int64]int {
+	counts := map[int64]int{}
+	for _, ji := range r.data.Items {
+		if deleted.matches(ji.DeletedAt) && match(r.item(ji)) {
+			counts[ji.CategoryID]++
+		}
+	}
+	return counts
+}
+
+// inCategory reports whether item is in category, or true if category is "".
+func inCategory(item Item, category string) bool {
+	return category == "" || item.Category == normalizeCategory(category)
+}
+
+// jsonSorts mirrors searchSorts for the in-memory backend.
+var jsonSorts = map[string]func(a, b jsonItem) bool{
+	"":    nil,
+	"id":  nil,
+	"-id": func(a, b jsonItem) bool { return a.ID > b.ID },
+	"name": func(a, b jsonItem) bool {
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	},
+	"-name": func(a, b jsonItem) bool {
+		if a.Name != b.Name {
+			return a.Name > b.Name
+		}
+		return a.ID > b.ID
+	},
+	"created_at":  jsonOldest,
+	"-created_at": jsonNewest,
+}
+
+// jsonListSorts mirrors listSorts.
+var jsonListSorts = map[string]func(a, b jsonItem) bool{
+	"":       nil,
+	"newest": jsonNewest,
+	"oldest": jsonOldest,
+	"name":   jsonSorts["name"],
+}
+
+// jsonOldest and jsonNewest order by creation time. RFC3339 timestamps in
+// UTC compare correctly as strings, and "" sorts first like NULL does.
+func jsonOldest(a, b jsonItem) bool {
+	if a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt < b.CreatedAt
+	}
+	return a.ID < b.ID
+}
+
+func jsonNewest(a, b jsonItem) bool {
+	if a.CreatedAt != b.CreatedAt {
+		return a.CreatedAt > b.CreatedAt
+	}
+	return a.ID > b.ID
+}
+
+func (r *jsonRepository) QueryItems(_ context.Context, req SearchRequest) (Items, error) {
+	match := func(item Item) bool {
+		if req.Keyword != "" && !keywordMatch(item, req.Keyword) {
+			return false
+		}
+		if req.Filters == nil {
+			return true
+		}
+		for _, f := range req.Filters.All {
+			if !f.matches(item) {
+				return false
+			}
+		}
+		if len(req.Filters.Any) == 0 {
+			return true
+		}
+		for _, f := range req.Filters.Any {
+			if f.matches(item) {
+				return true
+			}
+		}
+		return false
+	}
+	items, _ := r.filterItems(ExcludeDeleted, match, jsonSorts[req.Sort], Page{Limit: req.Limit})
+	return items, nil
+}
+
+// EachItem copies the items out under the lock so that a slow fn does
+// not hold up writers.
+func (r *jsonRepository) EachItem(ctx context.Context, opts ListOptions, fn func(Item) error) error {
+	items, _ := r.filterItems(opts.Deleted, listMatch(opts), jsonListSorts[opts.Sort], Page{})
+	for _, item := range items.Items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *jsonRepository) GetItem(_ context.Context, id int64) (Item, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	i, ok := r.itemIndex[id]
+	if !ok || r.data.Items[i].DeletedAt != "" {
+		return Item{}, ErrItemNotFound
+	}
+	return r.item(r.data.Items[i]), nil
+}
+
+func (r *jsonRepository) TrashItem(_ context.Context, id int64) (Item, error) {
+	return r.setDeletedAt(id, timestamp(), ExcludeDeleted)
+}
+
+func (r *jsonRepository) RestoreItem(_ context.Context, id int64) (Item, error) {
+	return r.setDeletedAt(id, "", OnlyDeleted)
+}
+
+// setDeletedAt sets DeletedAt of the item with the id if it passes from,
+// which selects whether it is in the trash.
+func (r *jsonRepository) setDeletedAt(id int64, deletedAt string, from DeletedFilter) (Item, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i, ok := r.itemIndex[id]
+	if !ok || !from.matches(r.data.Items[i].DeletedAt) {
+		return Item{}, ErrItemNotFound
+	}
+	next := r.data
+	next.Items = append([]jsonItem(nil), r.data.Items...)
+	next.Items[i].DeletedAt = deletedAt
+	if err := r.commit(next); err != nil {
+		return Item{}, err
+	}
+	return r.item(r.data.Items[i]), nil
+}
+
+// matches evaluates the filter the way filterCondition does in SQL.
+func (f ItemFilter) matches(item Item) bool {
+	switch {
+	case f.Keyword != nil:
+		return keywordMatch(item, *f.Keyword)
+	case f.Category != nil:
+		return item.Category == normalizeCategory(*f.Category)
+	case f.MinPrice != nil:
+		return item.Price >= *f.MinPrice
+	default:
+		return item.Price <= *f.MaxPrice
+	}
+}
+
+// keywordMatch mirrors the keyword condition of filterCondition.
+func keywordMatch(item Item, keyword string) bool {
+	return likeContains(item.Name, keyword) || likeContains(item.Category, keyword)
+}
+
+// likeContains matches like sqlite's LIKE '%substr%', which folds case
+// for ASCII letters only.
+func likeContains(s, substr string) bool {
+	return strings.Contains(asciiLower(s), asciiLower(substr))
+}
+
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/labstack/gommon/random"
+)
+
+// accessLogFormat is middleware.Logger's default JSON line with the id
+// under the same request_id key as the handler logs.
+const accessLogFormat = `{"time":"${time_rfc3339_nano}","request_id":"${id}","remote_ip":"${remote_ip}",` +
+	`"host":"${host}","method":"${method}","uri":"${uri}","user_agent":"${user_agent}",` +
+	`"status":${status},"error":"${error}","latency":${latency},"latency_human":"${latency_human}"` +
+	`,"bytes_in":${bytes_in},"bytes_out":${bytes_out}}` + "\n"
+
+// MaxRequestIDLength bounds the X-Request-Id accepted from clients.
+const MaxRequestIDLength = 64
+
+// requestIDMiddleware tags each request with an id, taken from the
+// client's X-Request-Id when it sends a usable one. The id is returned in
+// the X-Request-Id response header, read by middleware.Logger for the
+// access log, and added to every line logged through c.Logger().
+func requestIDMiddleware(e *echo.Echo) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			id := req.Header.Get(echo.HeaderXRequestID)
+			if !validRequestID(id) {
+				id = random.String(32)
+				req.Header.Set(echo.HeaderXRequestID, id)
+			}
+			c.Response().Header().Set(echo.HeaderXRequestID, id)
+			c.SetLogger(requestLogger(e.Logger, id))
+			return next(c)
+		}
+	}
+}
+
+// validRequestID accepts ids that can go into a log line as they are.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MaxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// requestLogger returns a logger writing to the same output and at the
+// same level as parent, with request_id added to its JSON header.
+func requestLogger(parent echo.Logger, id string) echo.Logger {
+	l := log.New(parent.Prefix())
+	l.SetOutput(parent.Output())
+	l.SetLevel(parent.Level())
+	l.SetHeader(fmt.Sprintf(`{"time":"${time_rfc3339_nano}","level":"${level}","prefix":"${prefix}","request_id":%s,"file":"${short_file}","line":"${line}"}`, strconv.Quote(id)))
+	return l
+}
@@ -1,11 +1,30 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"image"
+	_ "image/gif"
+	"io"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"mercari-build-training/app/web"
 
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -13,67 +32,1053 @@ import (
 )
 
 const (
+	// ImgDir is the default image directory, relative to the working
+	// directory; IMAGE_DIR overrides it.
 	ImgDir = "images"
+
+	// ShutdownTimeout is how long in-flight requests get to finish on
+	// SIGINT or SIGTERM.
+	ShutdownTimeout = 10 * time.Second
+
+	DefaultPageLimit = 50
+	MaxPageLimit     = 1000
 )
 
 type Response struct {
 	Message string `json:"message"`
 }
 
+// AddItemResponse is the reply to POST /items. Message is kept for
+// clients written against the earlier message-only reply.
+type AddItemResponse struct {
+	Response
+	Item
+}
+
+// dbError answers a failed repository call: 503 if the store did not
+// respond in time or stayed locked, otherwise 500 with message. The
+// caller logs err.
+func dbError(err error, message string) error {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || isBusy(err) {
+		return newAPIError(http.StatusServiceUnavailable, CodeUnavailable, "Database did not respond in time, please retry")
+	}
+	return newAPIError(http.StatusInternalServerError, CodeInternal, message)
+}
+
+type ServerImpl struct {
+	repo ItemRepository
+	// aliases is nil when the storage backend has no alias support.
+	aliases CategoryAliasRepository
+	// imgDir holds the uploaded images.
+	imgDir string
+	conf   *configHolder
+	// cache holds recent item listings.
+	cache *itemsCache
+	// hooks announces new items to WEBHOOK_URL.
+	hooks *webhookNotifier
+}
+
+func newServerImpl(repo ItemRepository, conf *configHolder) ServerImpl {
+	s := ServerImpl{repo: repo, imgDir: conf.Load().ImageDir, conf: conf, cache: newItemsCache(), hooks: newWebhookNotifier(conf)}
+	if aliases, ok := repo.(CategoryAliasRepository); ok {
+		s.aliases = aliases
+	}
+	return s
+}
+
 func root(c echo.Context) error {
 	res := Response{Message: "Hello, world!"}
 	return c.JSON(http.StatusOK, res)
 }
 
-func addItem(c echo.Context) error {
-	// Get form data
-	name := c.FormValue("name")
-	c.Logger().Infof("Receive item: %s", name)
+// addItemRequest is the JSON body of POST /items. Items posted as JSON
+// have no image.
+type addItemRequest struct {
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	Price    int64  `json:"price"`
+}
 
-	message := fmt.Sprintf("item received: %s", name)
-	res := Response{Message: message}
+func (s ServerImpl) addItem(c echo.Context) error {
+	var item Item
+	var apiErr *apiError
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	switch mediaType {
+	case echo.MIMEApplicationJSON:
+		item, apiErr = decodeItemJSON(c)
+	case echo.MIMEMultipartForm, echo.MIMEApplicationForm:
+		item, apiErr = s.formItem(c)
+	default:
+		return newAPIError(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Content-Type must be multipart/form-data, application/x-www-form-urlencoded or application/json")
+	}
+	if apiErr != nil {
+		return apiErr
+	}
+	c.Logger().Infof("Receive item: %s", item.Name)
 
-	return c.JSON(http.StatusOK, res)
+	saved, err := s.repo.SaveItem(c.Request().Context(), item)
+	s.cache.invalidate()
+	if err != nil {
+		c.Logger().Errorf("Error while saving item: %s", err)
+		return dbError(err, "Error while saving item")
+	}
+
+	s.setImageURL(c, &saved)
+	s.notifyCreated(c, saved)
+	res := AddItemResponse{
+		Response: Response{Message: fmt.Sprintf("item received: %s", saved.Name)},
+		Item:     saved,
+	}
+	c.Response().Header().Set(echo.HeaderLocation, fmt.Sprintf("/items/%d", saved.ID))
+	return c.JSON(http.StatusCreated, res)
+}
+
+// decodeItemJSON reads a POST /items JSON body, validated like formItem.
+func decodeItemJSON(c echo.Context) (Item, *apiError) {
+	var req addItemRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return Item{}, err
+	}
+	item, err := req.item()
+	if err != nil {
+		return Item{}, newAPIError(http.StatusBadRequest, CodeInvalidItem, err.Error())
+	}
+	return item, nil
 }
 
-func getImg(c echo.Context) error {
-	// Create image path
-	imgPath := path.Join(ImgDir, c.Param("imageFilename"))
+// decodeJSONBody decodes the request body into v, answering 413 if it
+// goes over the body limit and 400 if it is not valid JSON.
+func decodeJSONBody(c echo.Context, v interface{}) *apiError {
+	if err := json.NewDecoder(c.Request().Body).Decode(v); err != nil {
+		var tooLargeErr *http.MaxBytesError
+		if errors.As(err, &tooLargeErr) {
+			return tooLarge(tooLargeErr.Limit)
+		}
+		return newAPIError(http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON body: "+err.Error())
+	}
+	return nil
+}
+
+// item validates the request like a form would be.
+func (req addItemRequest) item() (Item, error) {
+	name, category, err := validateItemFields(req.Name, req.Category)
+	if err != nil {
+		return Item{}, err
+	}
+	if req.Price < 0 {
+		return Item{}, errors.New("price must be a non-negative integer")
+	}
+	return Item{Name: name, Category: category, Price: req.Price}, nil
+}
+
+// MaxBulkItems caps the number of items in one POST /items/bulk request.
+const MaxBulkItems = 1000
+
+// addItems implements POST /items/bulk: a JSON array of items without
+// images, all saved in one transaction. An invalid entry rejects the
+// whole batch, naming its index.
+func (s ServerImpl) addItems(c echo.Context) error {
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if mediaType != echo.MIMEApplicationJSON {
+		return newAPIError(http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Content-Type must be application/json")
+	}
+	var reqs []addItemRequest
+	if err := decodeJSONBody(c, &reqs); err != nil {
+		return err
+	}
+	if len(reqs) == 0 {
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "At least one item is required")
+	}
+	if len(reqs) > MaxBulkItems {
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, fmt.Sprintf("At most %d items can be added at once", MaxBulkItems))
+	}
+
+	items := make([]Item, len(reqs))
+	for i, req := range reqs {
+		item, err := req.item()
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, CodeInvalidItem, fmt.Sprintf("item %d: %s", i, err))
+		}
+		items[i] = item
+	}
+	c.Logger().Infof("Receive %d items", len(items))
+
+	saved, err := s.repo.SaveItems(c.Request().Context(), items)
+	s.cache.invalidate()
+	if err != nil {
+		c.Logger().Errorf("Error while saving items: %s", err)
+		return dbError(err, "Error while saving items")
+	}
+	res := Items{Items: saved}
+	s.setImageURLs(c, res)
+	for _, item := range res.Items {
+		s.notifyCreated(c, item)
+	}
+	return c.JSON(http.StatusCreated, res)
+}
+
+// notifyCreated queues the webhook for a new item. Delivery happens in
+// the background and never fails the request.
+func (s ServerImpl) notifyCreated(c echo.Context, item Item) {
+	if !s.hooks.notify(item) {
+		c.Logger().Errorf("Webhook queue is full, dropped the webhook for item %d", item.ID)
+	}
+}
+
+// formItem reads a POST /items form, storing its image if it has one.
+func (s ServerImpl) formItem(c echo.Context) (Item, *apiError) {
+	if err := parseItemForm(c); err != nil {
+		return Item{}, err
+	}
+	name, category, err := validateItemFields(c.FormValue("name"), c.FormValue("category"))
+	if err != nil {
+		return Item{}, newAPIError(http.StatusBadRequest, CodeInvalidItem, err.Error())
+	}
+	price, err := parsePrice("price", c.FormValue("price"))
+	if err != nil {
+		return Item{}, newAPIError(http.StatusBadRequest, CodeInvalidItem, err.Error())
+	}
+	imageName, apiErr := s.formImage(c)
+	if apiErr != nil {
+		return Item{}, apiErr
+	}
+	return Item{Name: name, Category: category, ImageName: imageName, Price: price}, nil
+}
+
+func (s ServerImpl) updateItem(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidID, "Item id must be an integer")
+	}
+
+	item, apiErr := s.formItem(c)
+	if apiErr != nil {
+		return apiErr
+	}
+	c.Logger().Infof("Update item %d: %s", id, item.Name)
+
+	oldImage, orphaned, err := s.repo.UpdateItem(c.Request().Context(), id, item.Name, item.Category, item.ImageName, item.Price)
+	s.cache.invalidate()
+	if errors.Is(err, ErrItemNotFound) {
+		return newAPIError(http.StatusNotFound, CodeItemNotFound, "Item not found")
+	}
+	if err != nil {
+		c.Logger().Errorf("Error while updating item with ID %d: %s", id, err)
+		return dbError(err, "Error while updating item")
+	}
+	if orphaned {
+		if err := removeImage(s.imgDir, oldImage); err != nil {
+			c.Logger().Errorf("Error while removing image %s: %s", oldImage, err)
+		}
+	}
+
+	message := fmt.Sprintf("item updated: %s", item.Name)
+	return c.JSON(http.StatusOK, Response{Message: message})
+}
+
+// parseItemForm parses the request form up front. FormValue would hide a
+// body cut off by the size limit as missing fields.
+func parseItemForm(c echo.Context) *apiError {
+	err := c.Request().ParseMultipartForm(32 << 20)
+	var tooLargeErr *http.MaxBytesError
+	switch {
+	case err == nil, errors.Is(err, http.ErrNotMultipart):
+		return nil
+	case errors.As(err, &tooLargeErr):
+		return tooLarge(tooLargeErr.Limit)
+	default:
+		c.Logger().Debugf("Error while parsing form: %s", err)
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "Invalid form body")
+	}
+}
+
+// formImage returns the image of an item form: either a file uploaded as
+// "image", which is stored with saveImage, or the image_name of a
+// committed resumable upload. The image is optional: it returns "" if the
+// form has neither.
+func (s ServerImpl) formImage(c echo.Context) (string, *apiError) {
+	imageName := c.FormValue("image_name")
+	file, err := c.FormFile("image")
+	// Only a form without a file is fine; a broken multipart body is not.
+	if err != nil && !errors.Is(err, http.ErrMissingFile) && !errors.Is(err, http.ErrNotMultipart) {
+		c.Logger().Debugf("Error while reading image: %s", err)
+		return "", newAPIError(http.StatusBadRequest, CodeInvalidImage, "Error while reading image")
+	}
+	if file != nil {
+		if file.Size == 0 {
+			return "", newAPIError(http.StatusBadRequest, CodeInvalidImage, "image is empty")
+		}
+		limit := s.conf.Load().BodyLimit
+		if limit > 0 && file.Size > limit {
+			return "", tooLarge(limit)
+		}
+		// The upload is already parsed, so failing to open it is ours.
+		src, err := file.Open()
+		if err != nil {
+			c.Logger().Errorf("Error while opening image: %s", err)
+			return "", newAPIError(http.StatusInternalServerError, CodeInternal, "Error while opening image")
+		}
+		defer src.Close()
+		imageName, err = saveImage(s.imgDir, src, limit)
+		switch {
+		case errors.Is(err, errUnsupportedImage), errors.Is(err, errInvalidImage):
+			return "", newAPIError(http.StatusBadRequest, CodeInvalidImage, err.Error())
+		case errors.Is(err, errImageTooLarge):
+			return "", tooLarge(limit)
+		case err != nil:
+			c.Logger().Errorf("Error while saving image: %s", err)
+			return "", newAPIError(http.StatusInternalServerError, CodeInternal, "Error while saving image")
+		}
+	} else if imageName != "" {
+		if !isImageName(imageName) {
+			return "", newAPIError(http.StatusBadRequest, CodeInvalidImageName, "Invalid image_name")
+		}
+		if _, err := os.Stat(path.Join(s.imgDir, imageName)); err != nil {
+			return "", newAPIError(http.StatusBadRequest, CodeInvalidImageName, "Image not found: "+imageName)
+		}
+	}
+	return imageName, nil
+}
+
+// getItems lists a page of items, or all of them with ?stream=true.
+//
+// Cursors are the preferred way to page: a listing in id order, that is
+// without sort or offset, comes with next_cursor, and passing it back as
+// ?cursor= returns the next page, until next_cursor is "". Unlike offsets,
+// cursors neither repeat nor skip items when items are added or removed
+// between pages. limit and offset keep working, without next_cursor.
+func (s ServerImpl) getItems(c echo.Context) error {
+	opts, err := parseListOptions(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidQuery, err.Error())
+	}
+	cursorPaged := opts.Sort == "" && opts.Offset == 0
+	if v := c.QueryParam("cursor"); v != "" {
+		if !cursorPaged {
+			return newAPIError(http.StatusBadRequest, CodeInvalidQuery, "cursor cannot be combined with sort or offset")
+		}
+		if opts.After, err = parseCursor(v); err != nil {
+			return newAPIError(http.StatusBadRequest, CodeInvalidCursor, err.Error())
+		}
+	}
+	if s.listNotModified(c) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	if v := c.QueryParam("stream"); v != "" {
+		stream, err := strconv.ParseBool(v)
+		if err != nil {
+			return newAPIError(http.StatusBadRequest, CodeInvalidQuery, "stream must be true or false")
+		}
+		if stream {
+			if c.QueryParam("limit") != "" || c.QueryParam("offset") != "" || c.QueryParam("cursor") != "" {
+				return newAPIError(http.StatusBadRequest, CodeInvalidQuery, "stream cannot be combined with limit, offset or cursor")
+			}
+			return s.streamItems(c, opts)
+		}
+	}
+	// Read one item past the page to know whether another page follows.
+	limit := opts.Limit
+	if cursorPaged {
+		opts.Limit++
+	}
+	items, err := s.cache.readItems(c.Request().Context(), s.repo, opts)
+	if err != nil {
+		c.Logger().Errorf("Error while reading items: %s", err)
+		return dbError(err, "Error while reading items")
+	}
+	if cursorPaged {
+		next := ""
+		if len(items.Items.Items) > limit {
+			items.Items.Items = items.Items.Items[:limit]
+			next = formatCursor(items.Items.Items[limit-1].ID)
+		}
+		items.NextCursor = &next
+	}
+	s.setImageURLs(c, items.Items)
+	return c.JSON(http.StatusOK, items)
+}
+
+// ItemCount is the body of GET /items/count.
+type ItemCount struct {
+	Count int `json:"count"`
+}
+
+// getItemCount counts the items without listing them. It takes the
+// filters of GET /items, and keyword like GET /search.
+func (s ServerImpl) getItemCount(c echo.Context) error {
+	opts, err := parseListFilters(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidQuery, err.Error())
+	}
+	n, err := s.repo.CountItems(c.Request().Context(), c.QueryParam("keyword"), opts)
+	if err != nil {
+		c.Logger().Errorf("Error while counting items: %s", err)
+		return dbError(err, "Error while counting items")
+	}
+	return c.JSON(http.StatusOK, ItemCount{Count: n})
+}
+
+// setImageURL fills in item.ImageURL, pointing at the default image if
+// the item has none.
+func (s ServerImpl) setImageURL(c echo.Context, item *Item) {
+	name := item.ImageName
+	if name == "" {
+		name = "default.jpg"
+	}
+	item.ImageURL = s.imageBase(c) + "/image/" + name
+}
+
+// imageBase is the scheme and host the image URLs of c point at.
+func (s ServerImpl) imageBase(c echo.Context) string {
+	if base := s.conf.Load().PublicURL; base != "" {
+		return base
+	}
+	return c.Scheme() + "://" + c.Request().Host
+}
+
+// listNotModified sets the ETag of an item listing and reports whether
+// the client already has it, in which case the handler answers 304. The
+// tag is derived from the cache version rather than the body, so that a
+// match costs no query, and from the image base, which a reload of
+// PUBLIC_URL changes. It must be called before the listing is read.
+func (s ServerImpl) listNotModified(c echo.Context) bool {
+	h := fnv.New32a()
+	h.Write([]byte(s.imageBase(c)))
+	etag := fmt.Sprintf(`W/"%s-%x"`, s.cache.version(), h.Sum32())
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	return etagMatches(c.Request().Header.Get("If-None-Match"), etag)
+}
+
+func (s ServerImpl) setImageURLs(c echo.Context, items Items) {
+	for i := range items.Items {
+		s.setImageURL(c, &items.Items[i])
+	}
+}
+
+// parseListOptions reads the query parameters of an item listing.
+func parseListOptions(c echo.Context) (ListOptions, error) {
+	page, err := parsePage(c)
+	if err != nil {
+		return ListOptions{}, err
+	}
+	sort := c.QueryParam("sort")
+	if _, ok := listSorts[sort]; !ok {
+		return ListOptions{}, errors.New("sort must be one of newest, oldest or name")
+	}
+	opts, err := parseListFilters(c)
+	if err != nil {
+		return ListOptions{}, err
+	}
+	opts.Sort = sort
+	opts.Page = page
+	return opts, nil
+}
+
+// parseListFilters reads the query parameters selecting which items a
+// listing or count covers: category, price_min, price_max and
+// include_deleted.
+func parseListFilters(c echo.Context) (ListOptions, error) {
+	priceMin, priceMax, err := parsePriceRange(c.QueryParam("price_min"), c.QueryParam("price_max"))
+	if err != nil {
+		return ListOptions{}, err
+	}
+	deleted := ExcludeDeleted
+	if v := c.QueryParam("include_deleted"); v != "" {
+		include, err := strconv.ParseBool(v)
+		if err != nil {
+			return ListOptions{}, errors.New("include_deleted must be true or false")
+		}
+		if include {
+			deleted = IncludeDeleted
+		}
+	}
+	return ListOptions{
+		Category: c.QueryParam("category"),
+		PriceMin: priceMin,
+		PriceMax: priceMax,
+		Deleted:  deleted,
+	}, nil
+}
+
+// parsePage reads the limit and offset query parameters of a listing.
+func parsePage(c echo.Context) (Page, error) {
+	page := Page{Limit: DefaultPageLimit}
+	if v := c.QueryParam("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > MaxPageLimit {
+			return Page{}, fmt.Errorf("limit must be an integer between 1 and %d", MaxPageLimit)
+		}
+		page.Limit = limit
+	}
+	if v := c.QueryParam("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return Page{}, errors.New("offset must be a non-negative integer")
+		}
+		page.Offset = offset
+	}
+	return page, nil
+}
+
+// formatCursor returns the GET /items cursor continuing after the item
+// with the given id.
+func formatCursor(id int64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(id, 10)))
+}
+
+// parseCursor returns the id a cursor made by formatCursor continues
+// after.
+func parseCursor(cursor string) (int64, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, errors.New("cursor is invalid, list again without it")
+	}
+	id, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || id < 1 {
+		return 0, errors.New("cursor is invalid, list again without it")
+	}
+	return id, nil
+}
 
-	if !strings.HasSuffix(imgPath, ".jpg") {
-		res := Response{Message: "Image path does not end with .jpg"}
-		return c.JSON(http.StatusBadRequest, res)
+func (s ServerImpl) getInfoById(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidID, "Item id must be an integer")
+	}
+	// Ids start at 1, so there is nothing to look up below that.
+	if id < 1 {
+		return newAPIError(http.StatusNotFound, CodeItemNotFound, "Item not found")
+	}
+	item, err := s.repo.GetItem(c.Request().Context(), id)
+	if errors.Is(err, ErrItemNotFound) {
+		return newAPIError(http.StatusNotFound, CodeItemNotFound, "Item not found")
+	}
+	if err != nil {
+		c.Logger().Errorf("Error while searching item with ID %d: %s", id, err)
+		return dbError(err, "Error while reading item")
+	}
+	s.setImageURL(c, &item)
+	return c.JSON(http.StatusOK, item)
+}
+
+// deleteItem moves the item to the trash, or with ?permanent=true removes
+// it for good, trashed or not, along with its image once unreferenced.
+func (s ServerImpl) deleteItem(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidID, "Item id must be an integer")
+	}
+	permanent := false
+	if v := c.QueryParam("permanent"); v != "" {
+		if permanent, err = strconv.ParseBool(v); err != nil {
+			return newAPIError(http.StatusBadRequest, CodeInvalidQuery, "permanent must be true or false")
+		}
+	}
+	if !permanent {
+		return s.trashItem(c, id)
+	}
+
+	item, orphaned, err := s.repo.DeleteItem(c.Request().Context(), id)
+	s.cache.invalidate()
+	if errors.Is(err, ErrItemNotFound) {
+		return newAPIError(http.StatusNotFound, CodeItemNotFound, "Item not found")
+	}
+	if err != nil {
+		c.Logger().Errorf("Error while deleting item with ID %d: %s", id, err)
+		return dbError(err, "Error while deleting item")
+	}
+
+	// The row is gone at this point, so a failure to clean up the image
+	// only leaves an unreferenced file behind.
+	if orphaned {
+		if err := removeImage(s.imgDir, item.ImageName); err != nil {
+			c.Logger().Errorf("Error while removing image %s: %s", item.ImageName, err)
+		}
+	}
+
+	message := fmt.Sprintf("item deleted: %s", item.Name)
+	return c.JSON(http.StatusOK, Response{Message: message})
+}
+
+var errImageTooLarge = errors.New("image is too large")
+
+// saveImage stores src in imgDir under the sha256 of its contents and
+// returns the resulting file name. It fails with errImageTooLarge if src
+// is longer than limit bytes, unless limit is 0.
+func saveImage(imgDir string, src io.Reader, limit int64) (string, error) {
+	tmp, err := os.CreateTemp(imgDir, ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+
+	if limit > 0 {
+		src = io.LimitReader(src, limit+1)
+	}
+	hash := sha256.New()
+	n, err := io.Copy(tmp, io.TeeReader(src, hash))
+	if err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if limit > 0 && n > limit {
+		tmp.Close()
+		return "", errImageTooLarge
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	return storeImage(imgDir, tmp.Name(), hash.Sum(nil))
+}
+
+// imageExtensions maps the image formats accepted for upload, as sniffed
+// by http.DetectContentType, to the extension they are stored with.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// imageTypes is the inverse of imageExtensions.
+var imageTypes = map[string]string{}
+
+func init() {
+	for contentType, ext := range imageExtensions {
+		imageTypes[ext] = contentType
+	}
+}
+
+const (
+	// storedImageCache is used for uploaded images, whose names are the
+	// sha256 of their contents.
+	storedImageCache = "public, max-age=31536000, immutable"
+	// defaultImageCache is used for default.jpg, which may be replaced by
+	// a deployment.
+	defaultImageCache = "public, max-age=300"
+)
+
+var (
+	errUnsupportedImage = errors.New("image must be a JPEG, PNG, GIF or WebP file")
+	errInvalidImage     = errors.New("image data is corrupt or truncated")
+)
+
+// MaxImagePixels caps the width times height of an upload, since the
+// renditions decode it in full.
+const MaxImagePixels = 50_000_000
+
+// sniffImage returns the extension for the image format of the file at
+// name, and the decoded image unless there is no decoder for the format.
+// It fails with errUnsupportedImage, naming the detected type, if the
+// contents are not one of imageExtensions, and with errInvalidImage if
+// they do not decode as one.
+func sniffImage(name string) (string, image.Image, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", nil, err
+	}
+	detected := http.DetectContentType(head[:n])
+	ext, ok := imageExtensions[detected]
+	if !ok {
+		mediaType, _, _ := mime.ParseMediaType(detected)
+		return "", nil, fmt.Errorf("%w, not %s", errUnsupportedImage, mediaType)
+	}
+
+	// The magic bytes alone let through forged files. The header is
+	// checked first so that the size is known before decoding, which
+	// then catches truncated data.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	cfg, _, err := image.DecodeConfig(f)
+	switch {
+	case errors.Is(err, image.ErrFormat):
+		// No decoder is registered for the format, as for WebP in builds
+		// without cgo; the sniffed type has to do.
+		return ext, nil, nil
+	case err != nil:
+		return "", nil, fmt.Errorf("%w: %s", errInvalidImage, err)
+	case cfg.Width < 1 || cfg.Height < 1:
+		return "", nil, fmt.Errorf("%w: it has no pixels", errInvalidImage)
+	case int64(cfg.Width)*int64(cfg.Height) > MaxImagePixels:
+		return "", nil, fmt.Errorf("%w: %dx%d is more than %d pixels", errInvalidImage, cfg.Width, cfg.Height, MaxImagePixels)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", nil, err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return "", nil, fmt.Errorf("%w: %s", errInvalidImage, err)
+	}
+	return ext, img, nil
+}
+
+// storeImage moves the file at tmpPath into imgDir under the name derived
+// from its sha256 sum and image format. If that image is already stored
+// the file is left for the caller to remove.
+func storeImage(imgDir, tmpPath string, sum []byte) (string, error) {
+	ext, img, err := sniffImage(tmpPath)
+	if err != nil {
+		return "", err
+	}
+	imageName := fmt.Sprintf("%x", sum) + ext
+	imgPath := path.Join(imgDir, imageName)
+	if _, err := os.Stat(imgPath); err == nil {
+		// The file may be an orphan about to be referenced again. Touch
+		// it so that the image GC spares it until the item is stored.
+		now := time.Now()
+		os.Chtimes(imgPath, now, now)
+		return imageName, nil
+	}
+	// Flush before the rename so a crash cannot leave a truncated file
+	// under a hash name, which would then be served forever.
+	if err := syncFile(tmpPath); err != nil {
+		return "", err
+	}
+	// Temporary files are created 0600; stored images must be readable
+	// by whatever serves the directory besides us.
+	if err := os.Chmod(tmpPath, 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmpPath, imgPath); err != nil {
+		return "", err
+	}
+	// Best effort: a failed encode only costs the rendition, and getImg
+	// retries generating a missing one on demand.
+	if webpSupported && hasWebPRendition(imgPath) {
+		ensureWebP(imgPath, img)
+	}
+	if hasThumbnail(imgPath) {
+		ensureThumb(imgPath, img)
+	}
+	return imageName, nil
+}
+
+// syncFile flushes the file at name to disk. It is opened for writing
+// since Windows will not flush a read-only handle.
+func syncFile(name string) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// removeImage deletes a stored image together with its renditions.
+func removeImage(imgDir, imageName string) error {
+	if !isImageName(imageName) {
+		return fmt.Errorf("refusing to remove %q: not a stored image name", imageName)
+	}
+	imgPath := path.Join(imgDir, imageName)
+	paths := []string{webpPath(imgPath), thumbPath(imgPath), imgPath}
+	for _, w := range ResizeWidths {
+		paths = append(paths, resizedPath(imgDir, imgPath, w))
+	}
+	for _, p := range paths {
+		if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isImageName reports whether name looks like a file name produced by
+// saveImage.
+func isImageName(name string) bool {
+	ext := path.Ext(name)
+	if _, ok := imageTypes[ext]; !ok {
+		return false
+	}
+	hash := strings.TrimSuffix(name, ext)
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	for _, r := range hash {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// imageFilePath resolves the image file name requested by a client inside
+// imgDir. Names that could point anywhere else are rejected.
+func imageFilePath(imgDir, name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return "", errors.New("Invalid image file name")
+	}
+	dir := filepath.Clean(imgDir)
+	imgPath := filepath.Clean(filepath.Join(dir, name))
+	if rel, err := filepath.Rel(dir, imgPath); err != nil || rel != filepath.Base(imgPath) {
+		return "", errors.New("Invalid image file name")
+	}
+	return imgPath, nil
+}
+
+func (s ServerImpl) getImg(c echo.Context) error {
+	// Create image path. Echo leaves path parameters escaped, so decode
+	// the name first and validate what the filesystem will see.
+	name, err := url.PathUnescape(c.Param("imageFilename"))
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidImageName, "Invalid image file name")
+	}
+	imgPath, err := imageFilePath(s.imgDir, name)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidImageName, err.Error())
+	}
+
+	if _, ok := imageTypes[path.Ext(imgPath)]; !ok {
+		return newAPIError(http.StatusBadRequest, CodeInvalidImageName, "Image path does not end with .jpg, .png, .gif or .webp")
+	}
+	size := c.QueryParam("size")
+	if size != "" && size != "full" && size != "thumb" {
+		return newAPIError(http.StatusBadRequest, CodeInvalidQuery, "size must be thumb or full")
+	}
+	width := 0
+	if w := c.QueryParam("w"); w != "" {
+		if width, err = strconv.Atoi(w); err != nil || !validResizeWidth(width) {
+			return newAPIError(http.StatusBadRequest, CodeInvalidQuery, "w must be one of "+resizeWidthsText())
+		}
+		if size != "" {
+			return newAPIError(http.StatusBadRequest, CodeInvalidQuery, "w and size cannot be combined")
+		}
 	}
 	if _, err := os.Stat(imgPath); err != nil {
 		c.Logger().Debugf("Image not found: %s", imgPath)
-		imgPath = path.Join(ImgDir, "default.jpg")
+		imgPath = path.Join(s.imgDir, "default.jpg")
+	}
+	// Stored images are named after their contents and never change, and
+	// neither do their renditions. The default image is not, so it is
+	// tagged with its modification time and only cached briefly.
+	stored := isImageName(path.Base(imgPath))
+
+	if width > 0 {
+		// Resized images are JPEG whatever the source, made on the first
+		// request for each width. Images that do not decode are sent in
+		// full.
+		if resized, err := ensureResized(s.imgDir, imgPath, width); err == nil {
+			imgPath = resized
+		} else {
+			c.Logger().Debugf("No %dpx resize of %s: %s", width, imgPath, err)
+		}
+	} else if size == "thumb" && stored && hasThumbnail(imgPath) {
+		// Thumbnails of images stored before they existed are made on
+		// the first request. Images that do not decode are sent in full.
+		if thumb, err := ensureThumb(imgPath, nil); err == nil {
+			imgPath = thumb
+		} else {
+			c.Logger().Debugf("No thumbnail for %s: %s", imgPath, err)
+		}
+	} else if webpSupported && hasWebPRendition(imgPath) {
+		// Serve the WebP rendition to clients that accept it. The ETag
+		// names the file actually sent so caches never mix up the
+		// renditions.
+		c.Response().Header().Add("Vary", "Accept")
+		if acceptsWebP(c.Request().Header.Get("Accept")) {
+			if webp, err := ensureWebP(imgPath, nil); err == nil {
+				imgPath = webp
+			} else {
+				c.Logger().Debugf("No WebP rendition for %s: %s", imgPath, err)
+			}
+		}
+	}
+	etag, cacheControl := `"`+path.Base(imgPath)+`"`, storedImageCache
+	if !stored {
+		cacheControl = defaultImageCache
+		if fi, err := os.Stat(imgPath); err == nil {
+			etag = fmt.Sprintf(`"%s-%x"`, path.Base(imgPath), fi.ModTime().UnixNano())
+		}
+	}
+	c.Response().Header().Set("ETag", etag)
+	c.Response().Header().Set("Cache-Control", cacheControl)
+	if etagMatches(c.Request().Header.Get("If-None-Match"), etag) {
+		return c.NoContent(http.StatusNotModified)
 	}
+	c.Response().Header().Set(echo.HeaderContentType, imageTypes[path.Ext(imgPath)])
 	return c.File(imgPath)
 }
 
+// etagMatches reports whether an If-None-Match header lists etag. Weak
+// validators match too, as RFC 7232 asks for GET and HEAD.
+func etagMatches(ifNoneMatch, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
 func main() {
+	importJSON := flag.String("import-json", "", "import items from an items.json file and exit")
+	importImages := flag.String("import-images", "", "directory holding the images referenced by --import-json (default: images next to the file)")
+	flag.Parse()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Open the storage before anything else so a bad path stops the
+	// server right away instead of failing every request.
+	repo, err := newRepository(cfg)
+	if err != nil {
+		log.Fatalf("Cannot open storage: %s", err)
+	}
+	if r, ok := repo.(*sqliteRepository); ok && !r.fts {
+		log.Infof("SQLite has no FTS5 (build with -tags sqlite_fts5 to enable it): searching with LIKE")
+	}
+
+	if *importJSON != "" {
+		oldImgDir := *importImages
+		if oldImgDir == "" {
+			oldImgDir = filepath.Join(filepath.Dir(*importJSON), "images")
+		}
+		err := runImport(repo, cfg.ImageDir, *importJSON, oldImgDir)
+		repo.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	conf := newConfigHolder(cfg)
+	e, err := newServer(conf, repo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	watchReload(e, conf)
+
+	// Start server
+	go func() {
+		e.Logger.Infof("Starting server on port %s", cfg.Port)
+		if err := e.Start(":" + cfg.Port); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			e.Logger.Fatal(err)
+		}
+	}()
+
+	// Stop accepting connections on SIGINT/SIGTERM and let in-flight
+	// requests finish before the storage is closed under them.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	sig := <-stop
+	e.Logger.Infof("Received %s, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		repo.Close()
+		e.Logger.Fatalf("Shutdown did not complete: %s", err)
+	}
+	if err := repo.Close(); err != nil {
+		e.Logger.Errorf("Error while closing storage: %s", err)
+	}
+	e.Logger.Infof("Server stopped")
+}
+
+// newServer sets up the middleware and routes for repo without starting
+// to listen.
+func newServer(conf *configHolder, repo ItemRepository) (*echo.Echo, error) {
 	e := echo.New()
+	// Everything goes through the JSON logger instead.
+	e.HideBanner = true
+	e.HidePort = true
+	// Only believe X-Forwarded-For from proxies on loopback and private
+	// networks, so clients cannot pick the IP they are rate limited by.
+	e.IPExtractor = echo.ExtractIPFromXFFHeader()
+	e.JSONSerializer = prettyJSONSerializer{}
+	e.HTTPErrorHandler = httpErrorHandler
 
 	// Middleware
-	e.Use(middleware.Logger())
+	e.Use(requestIDMiddleware(e))
+	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{Format: accessLogFormat}))
 	e.Use(middleware.Recover())
-	e.Logger.SetLevel(log.INFO)
+	e.Use(gzipMiddleware())
+	e.Logger.SetLevel(logLevels[conf.Load().LogLevel])
 
-	frontURL := os.Getenv("FRONT_URL")
-	if frontURL == "" {
-		frontURL = "http://localhost:3000"
+	e.Use(corsMiddleware(conf))
+	e.Use(maintenanceMiddleware(conf))
+	e.Use(authMiddleware(conf))
+	e.Use(bodyLimitMiddleware(conf))
+	if conf.Load().APIToken == "" {
+		e.Logger.Warnf("API_TOKEN is not set: write requests are accepted without authentication")
 	}
-	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{frontURL},
-		AllowMethods: []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete},
-	}))
 
+	serverImpl := newServerImpl(repo, conf)
+
+	uploads := newUploadStore(conf, serverImpl.imgDir, UploadSessionTTL)
+	if err := uploads.init(); err != nil {
+		return nil, err
+	}
+	go uploads.gcLoop(e.Logger)
+	limiter := newRateLimiter(conf)
+	go limiter.sweepLoop(e.Logger)
+	go serverImpl.hooks.run(e.Logger)
+	if cfg := conf.Load(); cfg.WebhookURL != "" && cfg.WebhookSecret == "" {
+		e.Logger.Warnf("WEBHOOK_SECRET is not set: webhooks are sent unsigned")
+	}
 	// Routes
-	e.GET("/", root)
-	e.POST("/items", addItem)
-	e.GET("/image/:imageFilename", getImg)
+	e.GET("/healthz", healthz)
+	e.GET("/readyz", serverImpl.readyz)
+	e.GET("/api", root)
+	e.GET("/items", serverImpl.getItems)
+	e.POST("/items", serverImpl.addItem, limiter.middleware)
+	e.POST("/items/bulk", serverImpl.addItems, limiter.middleware)
+	e.GET("/items/export", serverImpl.exportItems)
+	e.GET("/items/count", serverImpl.getItemCount)
+	e.GET("/items/trash", serverImpl.getTrash)
+	e.GET("/items/:id", serverImpl.getInfoById)
+	e.PUT("/items/:id", serverImpl.updateItem)
+	e.DELETE("/items/:id", serverImpl.deleteItem)
+	e.POST("/items/:id/restore", serverImpl.restoreItem)
+	e.GET("/categories", serverImpl.getCategories)
+	e.GET("/categories/:id/items", serverImpl.getCategoryItems)
+	e.PUT("/categories/:id", serverImpl.renameCategory)
+	e.POST("/categories/:id/merge", serverImpl.mergeCategory)
+	e.GET("/search", serverImpl.getSearch)
+	e.POST("/search", serverImpl.postSearch)
+	e.GET("/image/:imageFilename", serverImpl.getImg)
+	e.HEAD("/image/:imageFilename", serverImpl.getImg)
 
+	e.POST("/uploads/resumable", uploads.create)
+	e.GET("/uploads/resumable/:id", uploads.status)
+	e.PATCH("/uploads/resumable/:id", uploads.appendChunk)
+	e.POST("/uploads/resumable/:id/commit", uploads.commit)
 
-	// Start server
-	e.Logger.Fatal(e.Start(":9000"))
+	admin := e.Group("/admin")
+	admin.POST("/import/items-json", serverImpl.importItems)
+	admin.GET("/cache", serverImpl.getCacheStats)
+	admin.POST("/images/gc", serverImpl.gcImages)
+	if serverImpl.aliases != nil {
+		admin.GET("/category-aliases", serverImpl.getCategoryAliases)
+		admin.POST("/category-aliases", serverImpl.addCategoryAlias)
+		admin.DELETE("/category-aliases/:alias", serverImpl.deleteCategoryAlias)
+		admin.POST("/category-aliases/merge", serverImpl.mergeCategoryAlias)
+	}
+
+	// Frontend: registered last so it only sees paths no API route claimed
+	if !conf.Load().ServeFrontend {
+		e.GET("/", root)
+	} else if front, err := newFrontend(web.FS()); err != nil {
+		e.Logger.Warnf("Not serving the frontend: %s", err)
+		e.GET("/", root)
+	} else {
+		front.setAPIRoutes(e.Routes())
+		e.GET("/*", front.serve)
+	}
+
+	return e, nil
 }
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TestMain runs the tests from go/, where the server runs and SchemaPath
+// and the default images are found.
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
+}
+
+// testConfig is a Config for a server storing its images in a temporary
+// directory, with the logs off.
+func testConfig(t *testing.T) Config {
+	return Config{ImageDir: t.TempDir(), LogLevel: "off"}
+}
+
+func newTestServer(t *testing.T, cfg Config, repo ItemRepository) *echo.Echo {
+	t.Helper()
+	e, err := newServer(newConfigHolder(cfg), repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Logger.SetOutput(io.Discard)
+	return e
+}
+
+// copyDefaultImage copies images/default.jpg into dir and returns its
+// contents.
+func copyDefaultImage(t *testing.T, dir string) []byte {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join(ImgDir, "default.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "default.jpg"), b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func serve(e *echo.Echo, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// formRequest is a request with form as its url-encoded body.
+func formRequest(method, target string, form url.Values) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	return req
+}
+
+// jsonRequest is a request with body as its JSON body.
+func jsonRequest(method, target, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	return req
+}
+
+// errorCode returns the code of an error response, or "" if the body is
+// not an ErrorResponse.
+func errorCode(rec *httptest.ResponseRecorder) string {
+	var res ErrorResponse
+	json.Unmarshal(rec.Body.Bytes(), &res)
+	return res.Error.Code
+}
+
+// seedFake is the content of the fake repository in TestHandlers: items
+// 1 and 2 in "fashion", and item 3 in the trash.
+func seedFake() *fakeRepository {
+	r := &fakeRepository{}
+	r.save(Item{Name: "jacket", Category: "fashion", Price: 1000})
+	r.save(Item{Name: "shirt", Category: "fashion", Price: 2000})
+	r.save(Item{Name: "tent", Category: "outdoor", Price: 3000})
+	r.items[2].DeletedAt = timestamp()
+	return r
+}
+
+func TestHandlers(t *testing.T) {
+	tests := []struct {
+		name       string
+		req        func() *http.Request
+		failing    bool
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "list", req: get("/items"), wantStatus: http.StatusOK},
+		{name: "list db error", req: get("/items"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "add", req: form(http.MethodPost, "/items", "name", "cap", "category", "fashion", "price", "500"), wantStatus: http.StatusCreated},
+		{name: "add invalid", req: form(http.MethodPost, "/items", "category", "fashion"), wantStatus: http.StatusBadRequest, wantCode: CodeInvalidItem},
+		{name: "add db error", req: form(http.MethodPost, "/items", "name", "cap", "category", "fashion"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "bulk add", req: jsonBody(http.MethodPost, "/items/bulk", `[{"name":"cap","category":"fashion"}]`), wantStatus: http.StatusCreated},
+		{name: "bulk add db error", req: jsonBody(http.MethodPost, "/items/bulk", `[{"name":"cap","category":"fashion"}]`), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "export", req: get("/items/export"), wantStatus: http.StatusOK},
+		{name: "export db error", req: get("/items/export"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "count", req: get("/items/count"), wantStatus: http.StatusOK},
+		{name: "count db error", req: get("/items/count"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "trash", req: get("/items/trash"), wantStatus: http.StatusOK},
+		{name: "trash db error", req: get("/items/trash"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "get", req: get("/items/1"), wantStatus: http.StatusOK},
+		{name: "get not found", req: get("/items/99"), wantStatus: http.StatusNotFound, wantCode: CodeItemNotFound},
+		{name: "get trashed", req: get("/items/3"), wantStatus: http.StatusNotFound, wantCode: CodeItemNotFound},
+		{name: "get db error", req: get("/items/1"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "update", req: form(http.MethodPut, "/items/1", "name", "coat", "category", "fashion"), wantStatus: http.StatusOK},
+		{name: "update not found", req: form(http.MethodPut, "/items/99", "name", "coat", "category", "fashion"), wantStatus: http.StatusNotFound, wantCode: CodeItemNotFound},
+		{name: "update db error", req: form(http.MethodPut, "/items/1", "name", "coat", "category", "fashion"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "delete", req: form(http.MethodDelete, "/items/1"), wantStatus: http.StatusOK},
+		{name: "delete not found", req: form(http.MethodDelete, "/items/99"), wantStatus: http.StatusNotFound, wantCode: CodeItemNotFound},
+		{name: "delete db error", req: form(http.MethodDelete, "/items/1"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "purge", req: form(http.MethodDelete, "/items/3?permanent=true"), wantStatus: http.StatusOK},
+		{name: "purge not found", req: form(http.MethodDelete, "/items/99?permanent=true"), wantStatus: http.StatusNotFound, wantCode: CodeItemNotFound},
+		{name: "purge db error", req: form(http.MethodDelete, "/items/3?permanent=true"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "restore", req: form(http.MethodPost, "/items/3/restore"), wantStatus: http.StatusOK},
+		{name: "restore not found", req: form(http.MethodPost, "/items/1/restore"), wantStatus: http.StatusNotFound, wantCode: CodeItemNotFound},
+		{name: "restore db error", req: form(http.MethodPost, "/items/3/restore"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "categories", req: get("/categories"), wantStatus: http.StatusOK},
+		{name: "categories db error", req: get("/categories"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "category items", req: get("/categories/1/items"), wantStatus: http.StatusOK},
+		{name: "category items not found", req: get("/categories/99/items"), wantStatus: http.StatusNotFound, wantCode: CodeCategoryNotFound},
+		{name: "category items db error", req: get("/categories/1/items"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "rename category", req: form(http.MethodPut, "/categories/1", "name", "clothes"), wantStatus: http.StatusOK},
+		{name: "rename category not found", req: form(http.MethodPut, "/categories/99", "name", "clothes"), wantStatus: http.StatusNotFound, wantCode: CodeCategoryNotFound},
+		{name: "rename category conflict", req: form(http.MethodPut, "/categories/1", "name", "outdoor"), wantStatus: http.StatusConflict, wantCode: CodeConflict},
+		{name: "rename category db error", req: form(http.MethodPut, "/categories/1", "name", "clothes"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "merge category", req: form(http.MethodPost, "/categories/2/merge", "target_id", "1"), wantStatus: http.StatusOK},
+		{name: "merge category not found", req: form(http.MethodPost, "/categories/99/merge", "target_id", "1"), wantStatus: http.StatusNotFound, wantCode: CodeCategoryNotFound},
+		{name: "merge category db error", req: form(http.MethodPost, "/categories/2/merge", "target_id", "1"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "search", req: get("/search?keyword=jacket"), wantStatus: http.StatusOK},
+		{name: "search db error", req: get("/search?keyword=jacket"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "structured search", req: jsonBody(http.MethodPost, "/search", `{"keyword":"jacket"}`), wantStatus: http.StatusOK},
+		{name: "structured search db error", req: jsonBody(http.MethodPost, "/search", `{"keyword":"jacket"}`), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "ready", req: get("/readyz"), wantStatus: http.StatusOK},
+		{name: "ready db error", req: get("/readyz"), failing: true, wantStatus: http.StatusServiceUnavailable},
+		{name: "import", req: jsonBody(http.MethodPost, "/admin/import/items-json", `{"items":[{"name":"cap","category":"fashion"}]}`), wantStatus: http.StatusOK},
+		{name: "import db error", req: jsonBody(http.MethodPost, "/admin/import/items-json", `{"items":[{"name":"cap","category":"fashion"}]}`), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+		{name: "image gc", req: form(http.MethodPost, "/admin/images/gc"), wantStatus: http.StatusOK},
+		{name: "image gc db error", req: form(http.MethodPost, "/admin/images/gc"), failing: true, wantStatus: http.StatusInternalServerError, wantCode: CodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := seedFake()
+			e := newTestServer(t, testConfig(t), repo)
+			repo.failing = tt.failing
+
+			rec := serve(e, tt.req())
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" {
+				if code := errorCode(rec); code != tt.wantCode {
+					t.Errorf("code = %q, want %q; body: %s", code, tt.wantCode, rec.Body)
+				}
+			}
+		})
+	}
+}
+
+// get, form and jsonBody build the requests of the handler tables.
+func get(target string) func() *http.Request {
+	return func() *http.Request { return httptest.NewRequest(http.MethodGet, target, nil) }
+}
+
+func form(method, target string, kv ...string) func() *http.Request {
+	return func() *http.Request {
+		values := url.Values{}
+		for i := 0; i+1 < len(kv); i += 2 {
+			values.Set(kv[i], kv[i+1])
+		}
+		return formRequest(method, target, values)
+	}
+}
+
+func jsonBody(method, target, body string) func() *http.Request {
+	return func() *http.Request { return jsonRequest(method, target, body) }
+}
+
+func TestGetItemByID(t *testing.T) {
+	tests := []struct {
+		id         string
+		wantStatus int
+		wantCode   string
+	}{
+		{id: "1", wantStatus: http.StatusOK},
+		{id: "99", wantStatus: http.StatusNotFound, wantCode: CodeItemNotFound},
+		{id: "0", wantStatus: http.StatusNotFound, wantCode: CodeItemNotFound},
+		{id: "-1", wantStatus: http.StatusNotFound, wantCode: CodeItemNotFound},
+		{id: "abc", wantStatus: http.StatusBadRequest, wantCode: CodeInvalidID},
+		{id: "1.5", wantStatus: http.StatusBadRequest, wantCode: CodeInvalidID},
+		{id: "99999999999999999999", wantStatus: http.StatusBadRequest, wantCode: CodeInvalidID},
+	}
+	e := newTestServer(t, testConfig(t), seedFake())
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			rec := serve(e, get("/items/"+tt.id)())
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" {
+				if code := errorCode(rec); code != tt.wantCode {
+					t.Errorf("code = %q, want %q", code, tt.wantCode)
+				}
+				return
+			}
+			var item Item
+			if err := json.Unmarshal(rec.Body.Bytes(), &item); err != nil || item.ID != 1 || item.Name != "jacket" {
+				t.Errorf("body = %s, want item 1", rec.Body)
+			}
+		})
+	}
+}
+
+// TestGetImagePathTraversal requests files outside the image directory
+// by every encoding of a path we know of. None may be served.
+func TestGetImagePathTraversal(t *testing.T) {
+	root := t.TempDir()
+	cfg := testConfig(t)
+	cfg.ImageDir = filepath.Join(root, "images")
+	if err := os.Mkdir(cfg.ImageDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	defaultJPG := copyDefaultImage(t, cfg.ImageDir)
+	if err := os.WriteFile(filepath.Join(root, "secret.jpg"), []byte("SECRET"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e := newTestServer(t, cfg, &fakeRepository{})
+
+	if rec := serve(e, get("/image/default.jpg")()); rec.Code != http.StatusOK || rec.Body.String() != string(defaultJPG) {
+		t.Fatalf("default.jpg: status = %d, want 200 with the image", rec.Code)
+	}
+	payloads := []string{
+		"..%2Fsecret.jpg",
+		"%2E%2E%2Fsecret.jpg",
+		"..%5Csecret.jpg",
+		"images%2F..%2F..%2Fimages%2F..%2Fsecret.jpg",
+		"%2E%2E",
+		"..",
+		"%2F" + url.PathEscape(filepath.Join(root, "secret.jpg")),
+		url.PathEscape(filepath.Join(root, "secret.jpg")),
+		"..%2F..%2F..%2F..%2F..%2F..%2Fetc%2Fpasswd%00.jpg",
+	}
+	for _, payload := range payloads {
+		rec := serve(e, get("/image/"+payload)())
+		if rec.Code != http.StatusBadRequest || errorCode(rec) != CodeInvalidImageName {
+			t.Errorf("%s: status = %d, code = %q, want 400 %s", payload, rec.Code, errorCode(rec), CodeInvalidImageName)
+		}
+		if strings.Contains(rec.Body.String(), "SECRET") {
+			t.Errorf("%s: served the file outside the image directory", payload)
+		}
+	}
+}
+
+// TestDefaultImageReplaced replaces default.jpg after its renditions are
+// made. They must be redone, rather than served under the old ETag.
+func TestDefaultImageReplaced(t *testing.T) {
+	cfg := testConfig(t)
+	copyDefaultImage(t, cfg.ImageDir)
+	e := newTestServer(t, cfg, &fakeRepository{})
+	requests := map[string]func() *http.Request{
+		"resized": get(fmt.Sprintf("/image/default.jpg?w=%d", ResizeWidths[0])),
+	}
+	if webpSupported {
+		requests["webp"] = func() *http.Request {
+			req := get("/image/default.jpg")()
+			req.Header.Set("Accept", "image/webp")
+			return req
+		}
+	}
+
+	before := map[string]*httptest.ResponseRecorder{}
+	for name, req := range requests {
+		rec := serve(e, req())
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", name, rec.Code)
+		}
+		before[name] = rec
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.Set(0, 0, color.Black)
+	f, err := os.Create(filepath.Join(cfg.ImageDir, "default.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(f, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Clear of the mtime granularity of the file system.
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(f.Name(), later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, req := range requests {
+		old := before[name]
+		rec := serve(e, req())
+		if rec.Code != http.StatusOK || rec.Body.String() == old.Body.String() {
+			t.Errorf("%s: status = %d, want 200 with a new rendition", name, rec.Code)
+		}
+		if etag := rec.Header().Get("ETag"); etag == old.Header().Get("ETag") {
+			t.Errorf("%s: ETag = %s, unchanged by the replacement", name, etag)
+		}
+		revalidate := req()
+		revalidate.Header.Set("If-None-Match", old.Header().Get("ETag"))
+		if rec := serve(e, revalidate); rec.Code != http.StatusOK {
+			t.Errorf("%s: revalidating the old ETag: status = %d, want 200", name, rec.Code)
+		}
+	}
+}
+
+func TestItemsETag(t *testing.T) {
+	e := newTestServer(t, testConfig(t), seedFake())
+	withETag := func(etag string) *http.Request {
+		req := get("/items")()
+		req.Header.Set("If-None-Match", etag)
+		return req
+	}
+
+	first := serve(e, get("/items")())
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" || first.Body.Len() == 0 {
+		t.Fatalf("first request: status = %d, ETag = %q, want 200 with an ETag and the items", first.Code, etag)
+	}
+
+	rec := serve(e, withETag(etag))
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("matching If-None-Match: status = %d, body = %q, want 304 without a body", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("ETag"); got != etag {
+		t.Errorf("matching If-None-Match: ETag = %q, want %q", got, etag)
+	}
+	if rec := serve(e, withETag(`W/"stale", `+etag)); rec.Code != http.StatusNotModified {
+		t.Errorf("If-None-Match listing the ETag: status = %d, want 304", rec.Code)
+	}
+
+	if rec := serve(e, withETag(`W/"stale"`)); rec.Code != http.StatusOK || rec.Body.String() != first.Body.String() {
+		t.Errorf("mismatching If-None-Match: status = %d, want 200 with the items", rec.Code)
+	}
+
+	// Every write the listing shows changes the ETag, the old one then
+	// being a mismatch.
+	writes := []func() *http.Request{
+		form(http.MethodPost, "/items", "name", "cap", "category", "fashion"),
+		form(http.MethodPut, "/categories/1", "name", "clothes"),
+		form(http.MethodDelete, "/items/1"),
+	}
+	for _, write := range writes {
+		if rec := serve(e, write()); rec.Code >= 300 {
+			t.Fatalf("write: status = %d; body: %s", rec.Code, rec.Body)
+		}
+		rec := serve(e, withETag(etag))
+		if rec.Code != http.StatusOK {
+			t.Errorf("after a write: status = %d, want 200", rec.Code)
+		}
+		next := rec.Header().Get("ETag")
+		if next == etag {
+			t.Errorf("after a write: ETag is still %q", etag)
+		}
+		etag = next
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitIdle is how long a client's bucket is kept after its last
+// request. It is refilled by then for any sensible rate, so dropping it
+// changes nothing for the client.
+const RateLimitIdle = 10 * time.Minute
+
+// rateLimiter keeps one token bucket per client IP, sized by the
+// CreateRate and CreateBurst of the live config.
+type rateLimiter struct {
+	conf *configHolder
+
+	mu      sync.Mutex
+	limit   rate.Limit
+	burst   int
+	clients map[string]*rateClient
+}
+
+type rateClient struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(conf *configHolder) *rateLimiter {
+	return &rateLimiter{conf: conf, clients: map[string]*rateClient{}}
+}
+
+// middleware answers 429 with Retry-After once the client has used up its
+// burst. A CreateRate of 0 disables it.
+func (l *rateLimiter) middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := l.conf.Load()
+		if cfg.CreateRate <= 0 {
+			return next(c)
+		}
+		if wait := l.reserve(c.RealIP(), rate.Limit(cfg.CreateRate), cfg.CreateBurst, time.Now()); wait > 0 {
+			c.Response().Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return newAPIError(http.StatusTooManyRequests, CodeRateLimited, "Too many requests, please retry later")
+		}
+		return next(c)
+	}
+}
+
+// reserve takes a token from the bucket of ip, or returns how long until
+// one is available without taking it.
+func (l *rateLimiter) reserve(ip string, limit rate.Limit, burst int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Buckets made under a previous config would keep the old rate.
+	if limit != l.limit || burst != l.burst {
+		l.limit, l.burst = limit, burst
+		l.clients = map[string]*rateClient{}
+	}
+	client, ok := l.clients[ip]
+	if !ok {
+		client = &rateClient{limiter: rate.NewLimiter(limit, burst)}
+		l.clients[ip] = client
+	}
+	client.lastSeen = now
+
+	r := client.limiter.ReserveN(now, 1)
+	if wait := r.DelayFrom(now); wait > 0 {
+		r.CancelAt(now)
+		return wait
+	}
+	return 0
+}
+
+// sweep forgets the clients idle for longer than RateLimitIdle and
+// reports how many there were.
+func (l *rateLimiter) sweep(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	for ip, client := range l.clients {
+		if now.Sub(client.lastSeen) > RateLimitIdle {
+			delete(l.clients, ip)
+			n++
+		}
+	}
+	return n
+}
+
+func (l *rateLimiter) sweepLoop(logger echo.Logger) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if n := l.sweep(now); n > 0 {
+			logger.Debugf("Forgot the rate limits of %d idle clients", n)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/labstack/gommon/bytes"
+)
+
+// corsMiddleware checks origins against the live config so reloads take
+// effect without rebuilding the middleware chain.
+func corsMiddleware(h *configHolder) echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOriginFunc: func(origin string) (bool, error) {
+			for _, allowed := range h.Load().AllowOrigins {
+				if allowed == "*" || allowed == origin {
+					return true, nil
+				}
+			}
+			return false, nil
+		},
+		AllowMethods: []string{http.MethodGet, http.MethodPut, http.MethodPost, http.MethodPatch, http.MethodDelete},
+		// Lets the frontend report the id of a failed request.
+		ExposeHeaders: []string{echo.HeaderXRequestID},
+	})
+}
+
+// bodyLimitMiddleware rejects request bodies larger than the configured
+// BodyLimit. A limit of 0 disables the check.
+func bodyLimitMiddleware(h *configHolder) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			limit := h.Load().BodyLimit
+			if limit <= 0 {
+				return next(c)
+			}
+			req := c.Request()
+			if req.ContentLength > limit {
+				return tooLarge(limit)
+			}
+			req.Body = http.MaxBytesReader(c.Response(), req.Body, limit)
+			return next(c)
+		}
+	}
+}
+
+// tooLarge is the error for a request body or upload over limit.
+func tooLarge(limit int64) *apiError {
+	return newAPIError(http.StatusRequestEntityTooLarge, CodePayloadTooLarge, fmt.Sprintf("Request body is larger than the limit of %s", bytes.Format(limit)))
+}
+
+// maintenanceMiddleware answers every write request with 503 while a
+// maintenance message is configured. Reads keep working.
+func maintenanceMiddleware(h *configHolder) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			msg := h.Load().MaintenanceMessage
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				if msg != "" {
+					return newAPIError(http.StatusServiceUnavailable, CodeUnavailable, msg)
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// readOnlyPosts lists the POST routes that only read, which stay public
+// like GET requests.
+var readOnlyPosts = map[string]bool{
+	"/search": true,
+}
+
+// authMiddleware requires "Authorization: Bearer <APIToken>" on write
+// requests. It lets everything through while APIToken is empty.
+func authMiddleware(h *configHolder) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token := h.Load().APIToken
+			if token == "" {
+				return next(c)
+			}
+			switch c.Request().Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				return next(c)
+			case http.MethodPost:
+				if readOnlyPosts[c.Path()] {
+					return next(c)
+				}
+			}
+
+			auth := c.Request().Header.Get(echo.HeaderAuthorization)
+			got, ok := strings.CutPrefix(auth, "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+				if auth == "" {
+					return newAPIError(http.StatusUnauthorized, CodeUnauthorized, "An Authorization: Bearer token is required")
+				}
+				return newAPIError(http.StatusUnauthorized, CodeUnauthorized, "Invalid API token")
+			}
+			return next(c)
+		}
+	}
+}
+
+// reloadConfig re-reads the configuration and applies the reloadable part
+// of it to the running server.
+func reloadConfig(e *echo.Echo, h *configHolder) {
+	next, err := loadConfig()
+	if err != nil {
+		e.Logger.Errorf("Config reload failed, keeping the current config: %s", err)
+		return
+	}
+	changed, ignored := h.reload(next)
+	e.Logger.SetLevel(logLevels[h.Load().LogLevel])
+	if len(changed) == 0 && len(ignored) == 0 {
+		e.Logger.Infof("Config reloaded: nothing changed")
+	}
+	for _, c := range changed {
+		e.Logger.Infof("Config reloaded: %s", c)
+	}
+	for _, name := range ignored {
+		e.Logger.Warnf("Config reload: %s changed but requires a restart, ignored", name)
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	addItem := form(http.MethodPost, "/items", "name", "cap", "category", "fashion")
+	tests := []struct {
+		name       string
+		token      string
+		req        func() *http.Request
+		auth       string
+		wantStatus int
+	}{
+		{name: "allowed", token: "secret", req: addItem, auth: "Bearer secret", wantStatus: http.StatusCreated},
+		{name: "allowed update", token: "secret", req: form(http.MethodPut, "/items/1", "name", "coat", "category", "fashion"), auth: "Bearer secret", wantStatus: http.StatusOK},
+		{name: "denied without token", token: "secret", req: addItem, wantStatus: http.StatusUnauthorized},
+		{name: "denied wrong token", token: "secret", req: addItem, auth: "Bearer other", wantStatus: http.StatusUnauthorized},
+		{name: "denied other scheme", token: "secret", req: addItem, auth: "Basic c2VjcmV0", wantStatus: http.StatusUnauthorized},
+		{name: "denied update", token: "secret", req: form(http.MethodPut, "/items/1", "name", "coat", "category", "fashion"), wantStatus: http.StatusUnauthorized},
+		{name: "denied delete", token: "secret", req: form(http.MethodDelete, "/items/1"), wantStatus: http.StatusUnauthorized},
+		{name: "public read", token: "secret", req: get("/items"), wantStatus: http.StatusOK},
+		{name: "public search", token: "secret", req: jsonBody(http.MethodPost, "/search", `{"keyword":"jacket"}`), wantStatus: http.StatusOK},
+		{name: "disabled", req: addItem, wantStatus: http.StatusCreated},
+		{name: "disabled ignores token", req: addItem, auth: "Bearer whatever", wantStatus: http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.APIToken = tt.token
+			e := newTestServer(t, cfg, seedFake())
+
+			req := tt.req()
+			if tt.auth != "" {
+				req.Header.Set(echo.HeaderAuthorization, tt.auth)
+			}
+			rec := serve(e, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d; body: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == http.StatusUnauthorized {
+				if code := errorCode(rec); code != CodeUnauthorized {
+					t.Errorf("code = %q, want %q", code, CodeUnauthorized)
+				}
+				if got := rec.Header().Get(echo.HeaderWWWAuthenticate); got != "Bearer" {
+					t.Errorf("WWW-Authenticate = %q, want Bearer", got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/labstack/echo/v4"
+)
+
+// watchReload reloads the configuration whenever the process gets SIGHUP.
+func watchReload(e *echo.Echo, h *configHolder) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			e.Logger.Infof("Received SIGHUP, reloading config")
+			reloadConfig(e, h)
+		}
+	}()
+}
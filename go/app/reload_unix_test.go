@@ -0,0 +1,74 @@
+//go:build !windows
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// TestReloadOnSIGHUP changes FRONT_URL under a running server and checks
+// that SIGHUP makes it honor the new origin on the same listener.
+func TestReloadOnSIGHUP(t *testing.T) {
+	imageDir := t.TempDir()
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("LOG_LEVEL", "off")
+	t.Setenv("IMAGE_DIR", imageDir)
+	t.Setenv("FRONT_URL", "http://old.example")
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newConfigHolder(cfg)
+	e, err := newServer(h, seedFake())
+	if err != nil {
+		t.Fatal(err)
+	}
+	watchReload(e, h)
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+
+	allowed := func(origin string) bool {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/items", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(echo.HeaderOrigin, origin)
+		res, err := srv.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.Header.Get(echo.HeaderAccessControlAllowOrigin) == origin
+	}
+	if !allowed("http://old.example") || allowed("http://new.example") {
+		t.Fatal("before SIGHUP: want only http://old.example allowed")
+	}
+
+	t.Setenv("FRONT_URL", "http://new.example")
+	// IMAGE_DIR needs a restart, so the reload keeps the current one.
+	t.Setenv("IMAGE_DIR", t.TempDir())
+	if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !allowed("http://new.example") {
+		if time.Now().After(deadline) {
+			t.Fatal("after SIGHUP: http://new.example is still not allowed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if allowed("http://old.example") {
+		t.Error("after SIGHUP: http://old.example is still allowed")
+	}
+	if got := h.Load().ImageDir; got != imageDir {
+		t.Errorf("after SIGHUP: ImageDir = %q, want %q kept until a restart", got, imageDir)
+	}
+}
@@ -0,0 +1,6 @@
+package main
+
+import "github.com/labstack/echo/v4"
+
+// watchReload is a no-op: there is no SIGHUP on Windows.
+func watchReload(e *echo.Echo, h *configHolder) {}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// WebPQuality is the lossy quality used for WebP renditions.
+const WebPQuality = 80
+
+const (
+	// ThumbSize is the long edge of thumbnails, in pixels.
+	ThumbSize = 240
+	// ThumbQuality is the JPEG quality of thumbnails.
+	ThumbQuality = 75
+)
+
+// ResizeWidths are the widths GET /image accepts in ?w=. Only these are
+// made, so that the resize cache stays bounded.
+var ResizeWidths = []int{120, 240, 480, 960}
+
+const (
+	// ResizeCacheDir is the directory, under the images directory, that
+	// holds the resized images.
+	ResizeCacheDir = "cache"
+	// ResizeQuality is the JPEG quality of resized images.
+	ResizeQuality = 80
+)
+
+// renditionLocks serializes generation per output file so concurrent
+// requests for a missing rendition encode it only once.
+var renditionLocks sync.Map
+
+// webpPath returns the path of the WebP rendition stored next to the
+// image at imgPath.
+func webpPath(imgPath string) string {
+	return strings.TrimSuffix(imgPath, path.Ext(imgPath)) + ".webp"
+}
+
+// hasWebPRendition reports whether the image at imgPath gets a WebP
+// rendition. WebP originals are served as they are, and GIFs are left
+// alone so animations survive.
+func hasWebPRendition(imgPath string) bool {
+	ext := path.Ext(imgPath)
+	return ext == ".jpg" || ext == ".png"
+}
+
+// ensureWebP returns the path of the WebP rendition of imgPath, encoding
+// and caching it on disk first if it is missing or stale. img is the
+// decoded image if the caller has it, or nil.
+func ensureWebP(imgPath string, img image.Image) (string, error) {
+	return ensureRendition(imgPath, img, webpPath(imgPath), encodeWebP)
+}
+
+// thumbPath returns the path of the thumbnail stored next to the image
+// at imgPath.
+func thumbPath(imgPath string) string {
+	return strings.TrimSuffix(imgPath, path.Ext(imgPath)) + "_thumb.jpg"
+}
+
+// hasThumbnail reports whether the image at imgPath gets a thumbnail.
+// Like WebP renditions, they are made from the JPEG and PNG originals
+// the standard library decodes; other images are only served full size.
+func hasThumbnail(imgPath string) bool {
+	return hasWebPRendition(imgPath)
+}
+
+// ensureThumb returns the path of the thumbnail of imgPath, scaling and
+// caching it on disk first if it is missing or stale. img is as for
+// ensureWebP.
+func ensureThumb(imgPath string, img image.Image) (string, error) {
+	return ensureRendition(imgPath, img, thumbPath(imgPath), func(w io.Writer, img image.Image) error {
+		return jpeg.Encode(w, scaleDown(img, ThumbSize), &jpeg.Options{Quality: ThumbQuality})
+	})
+}
+
+// validResizeWidth reports whether w is one of ResizeWidths.
+func validResizeWidth(w int) bool {
+	for _, rw := range ResizeWidths {
+		if w == rw {
+			return true
+		}
+	}
+	return false
+}
+
+// resizeWidthsText lists ResizeWidths for error messages.
+func resizeWidthsText() string {
+	s := make([]string, len(ResizeWidths))
+	for i, w := range ResizeWidths {
+		s[i] = strconv.Itoa(w)
+	}
+	return strings.Join(s, ", ")
+}
+
+// resizedPath returns the path of the image at imgPath scaled to width,
+// in the resize cache of imgDir.
+func resizedPath(imgDir, imgPath string, width int) string {
+	name := strings.TrimSuffix(path.Base(imgPath), path.Ext(imgPath))
+	return path.Join(imgDir, ResizeCacheDir, name+"_w"+strconv.Itoa(width)+".jpg")
+}
+
+// resizedHash returns the image hash of a file in the resize cache, or ""
+// if name is not one.
+func resizedHash(name string) string {
+	base, ok := strings.CutSuffix(name, ".jpg")
+	i := strings.LastIndex(base, "_w")
+	if !ok || i < 0 {
+		return ""
+	}
+	if _, err := strconv.Atoi(base[i+2:]); err != nil {
+		return ""
+	}
+	if hash := base[:i]; isImageName(hash + ".jpg") {
+		return hash
+	}
+	return ""
+}
+
+// ensureResized returns the path of the image at imgPath scaled down to
+// width, as a JPEG, making and caching it first if needed. Images already
+// narrower keep their size.
+func ensureResized(imgDir, imgPath string, width int) (string, error) {
+	dst := resizedPath(imgDir, imgPath, width)
+	if err := os.MkdirAll(path.Dir(dst), 0o755); err != nil {
+		return "", err
+	}
+	return ensureRendition(imgPath, nil, dst, func(w io.Writer, img image.Image) error {
+		return jpeg.Encode(w, scaleToWidth(img, width), &jpeg.Options{Quality: ResizeQuality})
+	})
+}
+
+// removeStale deletes the rendition dst if it is older than the image at
+// imgPath. Stored images never change, but the default image may be
+// replaced, and its renditions must then be redone.
+func removeStale(imgPath, dst string) error {
+	if isImageName(path.Base(imgPath)) {
+		return nil
+	}
+	src, err := os.Stat(imgPath)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(dst); err == nil && fi.ModTime().Before(src.ModTime()) {
+		os.Remove(dst)
+	}
+	return nil
+}
+
+// ensureRendition returns dst, first writing it with encode from the
+// image at imgPath if it does not exist yet or is stale. The image is
+// decoded from the file unless img is given.
+func ensureRendition(imgPath string, img image.Image, dst string, encode func(io.Writer, image.Image) error) (string, error) {
+	if err := removeStale(imgPath, dst); err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return dst, nil
+	}
+
+	l, _ := renditionLocks.LoadOrStore(dst, &sync.Mutex{})
+	mu := l.(*sync.Mutex)
+	mu.Lock()
+	defer mu.Unlock()
+	if _, err := os.Stat(dst); err == nil {
+		return dst, nil
+	}
+
+	if img == nil {
+		src, err := os.Open(imgPath)
+		if err != nil {
+			return "", err
+		}
+		defer src.Close()
+		if img, _, err = image.Decode(src); err != nil {
+			return "", err
+		}
+	}
+
+	tmp, err := os.CreateTemp(path.Dir(dst), ".rendition-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if err := encode(tmp, img); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return "", err
+	}
+	return dst, os.Rename(tmp.Name(), dst)
+}
+
+// scaleDown shrinks img so that its long edge is at most size pixels.
+func scaleDown(img image.Image, size int) *image.RGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	tw, th := w, h
+	if w >= h && w > size {
+		tw, th = size, h*size/w
+	} else if h > w && h > size {
+		tw, th = w*size/h, size
+	}
+	return resample(img, tw, th)
+}
+
+// scaleToWidth shrinks img to at most width pixels wide, keeping its
+// aspect ratio.
+func scaleToWidth(img image.Image, width int) *image.RGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	if w <= width {
+		return resample(img, w, h)
+	}
+	return resample(img, width, h*width/w)
+}
+
+// resample scales img to tw by th pixels, averaging the source pixels
+// under each output pixel, so it is only meant for shrinking. Transparent
+// areas are flattened onto white since JPEG has no alpha.
+func resample(img image.Image, tw, th int) *image.RGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if tw < 1 {
+		tw = 1
+	}
+	if th < 1 {
+		th = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+(y+1)*h/th
+		if y1 == y0 {
+			y1++
+		}
+		for x := 0; x < tw; x++ {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+(x+1)*w/tw
+			if x1 == x0 {
+				x1++
+			}
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			// The colours are premultiplied, so adding the uncovered
+			// part of white composites over it.
+			white := 0xffff - a/n
+			dst.SetRGBA(x, y, color.RGBA{
+				R: uint8((r/n + white) >> 8),
+				G: uint8((g/n + white) >> 8),
+				B: uint8((bl/n + white) >> 8),
+				A: 0xff,
+			})
+		}
+	}
+	return dst
+}
+
+// acceptsWebP reports whether the Accept header lists image/webp with a
+// non-zero quality.
+func acceptsWebP(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != "image/webp" {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
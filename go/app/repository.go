@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrItemNotFound = errors.New("item not found")
+
+type Item struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	// ImageName is the stored file name of the image.
+	//
+	// Deprecated: clients should use ImageURL; ImageName is kept in the
+	// JSON for the ones written against it.
+	ImageName string `json:"image_name,omitempty"`
+	// ImageURL is the absolute URL of the image, or of the default image
+	// if the item has none. Handlers set it; repositories leave it empty.
+	ImageURL string `json:"image_url,omitempty"`
+	// Price is in yen.
+	Price int64 `json:"price"`
+	// CreatedAt and UpdatedAt are RFC3339 timestamps in UTC, or "" for
+	// items stored before they were recorded.
+	CreatedAt string `json:"created_at"`
+	UpdatedAt string `json:"updated_at"`
+	// DeletedAt is when the item was moved to the trash, or "" if it is
+	// not in the trash.
+	DeletedAt string `json:"deleted_at,omitempty"`
+}
+
+// Items is the body of the item listings. Repositories always return a
+// non-nil slice, even when empty, so that clients get [] and not null.
+type Items struct {
+	Items []Item `json:"items"`
+}
+
+type Category struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// CategoryCount is a category with the number of its items.
+type CategoryCount struct {
+	Category
+	ItemCount int `json:"item_count"`
+}
+
+type Categories struct {
+	Categories []CategoryCount `json:"categories"`
+}
+
+// ItemsPage is one page of a listing together with the number of items
+// across all pages.
+type ItemsPage struct {
+	Items
+	Total int `json:"total"`
+	// NextCursor is set on GET /items listings in id order, and is "" on
+	// their last page.
+	NextCursor *string `json:"next_cursor,omitempty"`
+}
+
+// Page selects a window of a listing. A Limit of 0 means no limit. After,
+// when set, leaves out the items up to that id, for cursor paging through
+// a listing in id order.
+type Page struct {
+	Limit  int
+	Offset int
+	After  int64
+}
+
+// ListOptions selects the items returned by ReadItems.
+type ListOptions struct {
+	// Category restricts the listing unless it is "".
+	Category string
+	// Sort is a key of listSorts.
+	Sort string
+	// PriceMin and PriceMax bound the price inclusively when set.
+	PriceMin, PriceMax *int64
+	// Deleted selects items by whether they are in the trash.
+	Deleted DeletedFilter
+	Page
+}
+
+// DeletedFilter selects items by whether they are in the trash. The zero
+// value leaves trashed items out.
+type DeletedFilter int
+
+const (
+	ExcludeDeleted DeletedFilter = iota
+	IncludeDeleted
+	OnlyDeleted
+)
+
+// matches reports whether an item with the given DeletedAt passes f.
+func (f DeletedFilter) matches(deletedAt string) bool {
+	switch f {
+	case IncludeDeleted:
+		return true
+	case OnlyDeleted:
+		return deletedAt != ""
+	default:
+		return deletedAt == ""
+	}
+}
+
+// timestamp returns the current time in the format of Item.CreatedAt.
+func timestamp() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// ItemRepository is the storage used by the item handlers. Each call
+// gives up with the context's error once ctx is done. Items in the trash
+// are only seen by listings that ask for them, RestoreItem and
+// DeleteItem, but their images stay referenced.
+type ItemRepository interface {
+	// SaveItem stores a new item with the name, category, image and
+	// price of item, creating its category if needed. It returns the
+	// item as stored, with its id, category name and timestamps.
+	SaveItem(ctx context.Context, item Item) (Item, error)
+	// SaveItems stores all of items in one transaction, or none of them
+	// if it fails, and returns them as stored in the same order.
+	SaveItems(ctx context.Context, items []Item) ([]Item, error)
+	ReadItems(ctx context.Context, opts ListOptions) (ItemsPage, error)
+	// SearchItems returns a page of the items matched by opts for which
+	// every whitespace-separated term of keywords is contained in the item
+	// name or its category name, ignoring case. The terms are taken
+	// literally, wildcards included. Unless opts.Sort is set, the best
+	// matches come first where the backend can rank them.
+	SearchItems(ctx context.Context, keywords string, opts ListOptions) (ItemsPage, error)
+	// QueryItems runs a structured POST /search request.
+	QueryItems(ctx context.Context, req SearchRequest) (Items, error)
+	// EachItem calls fn with every item matched by opts, in opts.Sort
+	// order, stopping at the first error; opts.Page is ignored. It is not
+	// bounded by QueryTimeout, since fn may be writing to a slow client,
+	// and ends once ctx is done.
+	EachItem(ctx context.Context, opts ListOptions, fn func(Item) error) error
+	// GetItem returns ErrItemNotFound if there is no item with the id.
+	GetItem(ctx context.Context, id int64) (Item, error)
+	// TrashItem moves the item to the trash and returns it. It returns
+	// ErrItemNotFound if there is no item with the id outside the trash.
+	TrashItem(ctx context.Context, id int64) (Item, error)
+	// RestoreItem takes the item out of the trash and returns it. It
+	// returns ErrItemNotFound if there is no item with the id in the trash.
+	RestoreItem(ctx context.Context, id int64) (Item, error)
+	// UpdateItem replaces the name, category and price of the item, and its
+	// image unless imageName is empty. It returns the image the item had
+	// before and whether that image is no longer referenced by any item, or
+	// ErrItemNotFound if there is no item with the id.
+	UpdateItem(ctx context.Context, id int64, name, category, imageName string, price int64) (oldImage string, oldImageOrphaned bool, err error)
+	// DeleteItem removes the item for good, whether or not it is in the
+	// trash, and reports whether its image is no longer referenced by any
+	// other item. It returns ErrItemNotFound if there is no item with the
+	// id.
+	DeleteItem(ctx context.Context, id int64) (item Item, imageOrphaned bool, err error)
+	// ImageNames returns the image names referenced by items, including
+	// those in the trash.
+	ImageNames(ctx context.Context) (map[string]bool, error)
+	// ImportItems inserts items in a single transaction, skipping those
+	// identical to an existing item, and reports which ones were inserted.
+	// It is not bounded by QueryTimeout, since large imports run for
+	// long, and ends once ctx is done.
+	ImportItems(ctx context.Context, items []Item) ([]bool, error)
+	// CheckCategoryId returns the id of the category called name,
+	// creating it if it does not exist yet.
+	CheckCategoryId(ctx context.Context, name string) (int64, error)
+	// CountItems counts the items SearchItems would match, or with
+	// keywords "" those ReadItems would list, across all pages.
+	CountItems(ctx context.Context, keywords string, opts ListOptions) (int, error)
+	// ReadCategories lists all categories by name, each with the number
+	// of its items CountItems would count. opts.Category is ignored.
+	ReadCategories(ctx context.Context, keywords string, opts ListOptions) (Categories, error)
+	// GetCategory returns errCategoryNotFound if there is no category
+	// with the id.
+	GetCategory(ctx context.Context, id int64) (Category, error)
+	// RenameCategory renames the category to the normalized name. It
+	// returns errCategoryNotFound if there is no category with the id and
+	// errCategoryExists if another category already has the name.
+	RenameCategory(ctx context.Context, id int64, name string) (Category, error)
+	// MergeCategory moves the items of the category fromId to toId and
+	// removes fromId, all in one transaction. It returns the target
+	// category, or errCategoryNotFound if either id is unknown.
+	MergeCategory(ctx context.Context, fromId, toId int64) (CategoryMerge, error)
+	// Ping checks that the store can be reached and queried.
+	Ping(ctx context.Context) error
+	Close() error
+}
+
+// CategoryAliasRepository is implemented by backends that support
+// category aliases.
+type CategoryAliasRepository interface {
+	AddAlias(ctx context.Context, alias string, categoryId int64) (CategoryAlias, error)
+	ReadAliases(ctx context.Context) (CategoryAliases, error)
+	DeleteAlias(ctx context.Context, alias string) (bool, error)
+	MergeCategoryIntoAlias(ctx context.Context, fromId, toId int64) (MergeResult, error)
+}
+
+// normalizeCategory folds case and whitespace so that " Fashion " and
+// "fashion" end up in the same category.
+func normalizeCategory(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+const (
+	StorageSQLite = "sqlite"
+	StorageJSON   = "json"
+
+	JSONPath = "../db/items.json"
+)
+
+// newRepository opens the backend selected by cfg.Storage (sqlite by
+// default). cfg.StoragePath overrides the file it uses, and for sqlite
+// defaults to cfg.DBPath.
+func newRepository(cfg Config) (ItemRepository, error) {
+	storage, storagePath := cfg.Storage, cfg.StoragePath
+	switch storage {
+	case "", StorageSQLite:
+		if !sqliteSupported {
+			return nil, fmt.Errorf("this build has no sqlite support (built without cgo): set STORAGE=%s", StorageJSON)
+		}
+		if storagePath == "" {
+			storagePath = cfg.DBPath
+		}
+		if storagePath == "" {
+			storagePath = DBPath
+		}
+		if err := checkParentDir(storagePath); err != nil {
+			return nil, err
+		}
+		return newSQLiteRepository(storagePath)
+	case StorageJSON:
+		if storagePath == "" {
+			storagePath = JSONPath
+		}
+		if err := checkParentDir(storagePath); err != nil {
+			return nil, err
+		}
+		return newJSONRepository(storagePath)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE %q: must be %q or %q", storage, StorageSQLite, StorageJSON)
+	}
+}
+
+// checkParentDir makes sure the directory that will hold the storage file
+// at name exists, since both backends would otherwise only fail once they
+// first write.
+func checkParentDir(name string) error {
+	dir := filepath.Dir(name)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("directory for %s: %w", name, err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("directory for %s: %s is not a directory", name, dir)
+	}
+	return nil
+}
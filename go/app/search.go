@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	DefaultSearchLimit = 20
+	MaxSearchLimit     = 100
+)
+
+// itemSelect is the common projection for item listings; filters are
+// appended as a WHERE clause by itemQuery.
+const itemSelect = `SELECT items.id, items.name, categories.name, items.image_name,
+	items.price, items.created_at, items.updated_at, items.deleted_at
+	FROM items JOIN categories ON items.category_id = categories.id`
+
+// searchSorts maps the accepted sort keys to their ORDER BY clause. A
+// leading "-" means descending.
+var searchSorts = map[string]string{
+	"":            "items.id",
+	"id":          "items.id",
+	"-id":         "items.id DESC",
+	"name":        "items.name, items.id",
+	"-name":       "items.name DESC, items.id DESC",
+	"created_at":  listSorts["oldest"],
+	"-created_at": listSorts["newest"],
+}
+
+// listSorts maps the sort keys of GET /items to their ORDER BY clause.
+// Items without a timestamp sort as the oldest.
+var listSorts = map[string]string{
+	"":       "items.id",
+	"newest": "items.created_at DESC, items.id DESC",
+	"oldest": "items.created_at, items.id",
+	"name":   "items.name, items.id",
+}
+
+// ItemFilter is a single filter primitive, one of those the GET
+// endpoints take. Exactly one field is set.
+type ItemFilter struct {
+	Keyword  *string `json:"keyword,omitempty"`
+	Category *string `json:"category,omitempty"`
+	MinPrice *int64  `json:"min_price,omitempty"`
+	MaxPrice *int64  `json:"max_price,omitempty"`
+}
+
+// SearchFilters combines filter primitives one level deep: every filter in
+// All must match, and at least one filter in Any must match.
+type SearchFilters struct {
+	Any []ItemFilter `json:"any"`
+	All []ItemFilter `json:"all"`
+}
+
+type SearchRequest struct {
+	Keyword string         `json:"keyword"`
+	Filters *SearchFilters `json:"filters"`
+	Sort    string         `json:"sort"`
+	Limit   int            `json:"limit"`
+}
+
+// schemaError is returned for a request body that is valid JSON but does
+// not follow the search schema.
+type schemaError struct {
+	msg string
+}
+
+func (e *schemaError) Error() string { return e.msg }
+
+func (f *ItemFilter) UnmarshalJSON(data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return &schemaError{"filter must be an object"}
+	}
+	if len(fields) != 1 {
+		return &schemaError{"filter must have exactly one field"}
+	}
+	for key, raw := range fields {
+		switch key {
+		case "keyword", "category":
+			var v string
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return &schemaError{fmt.Sprintf("filter %q must be a string", key)}
+			}
+			if key == "keyword" {
+				f.Keyword = &v
+			} else {
+				f.Category = &v
+			}
+		case "min_price", "max_price":
+			var v int64
+			if err := json.Unmarshal(raw, &v); err != nil || v < 0 {
+				return &schemaError{fmt.Sprintf("filter %q must be a non-negative integer", key)}
+			}
+			if key == "min_price" {
+				f.MinPrice = &v
+			} else {
+				f.MaxPrice = &v
+			}
+		case "any", "all":
+			return &schemaError{fmt.Sprintf("%q cannot be nested inside a filter group", key)}
+		default:
+			return &schemaError{fmt.Sprintf("unknown filter %q", key)}
+		}
+	}
+	return nil
+}
+
+// itemQuery collects WHERE conditions together with their bound arguments.
+// User input must only ever reach the database through args.
+type itemQuery struct {
+	// join is added after the FROM clause of itemSelect.
+	join  string
+	where []string
+	args  []interface{}
+	// deleted is applied on top of where, so that no query forgets to
+	// leave out the trash.
+	deleted DeletedFilter
+}
+
+func (q *itemQuery) add(cond string, args ...interface{}) {
+	q.where = append(q.where, cond)
+	q.args = append(q.args, args...)
+}
+
+// addKeyword matches keyword as a substring of the item or category name.
+// Case is folded explicitly rather than relying on LIKE, which stops
+// folding once a column gets a non-default collation.
+func (q *itemQuery) addKeyword(keyword string) {
+	q.addFilter(ItemFilter{Keyword: &keyword})
+}
+
+// addKeywords matches every whitespace-separated term of keywords as a
+// substring of the item or category name, in any order.
+func (q *itemQuery) addKeywords(keywords string) {
+	for _, term := range strings.Fields(keywords) {
+		q.addKeyword(term)
+	}
+}
+
+// likePattern matches s anywhere in a LIKE ... ESCAPE '\' condition, with
+// the wildcards in s taken literally.
+func likePattern(s string) string {
+	return "%" + likeEscaper.Replace(s) + "%"
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func (q *itemQuery) addCategory(category string) {
+	q.addFilter(ItemFilter{Category: &category})
+}
+
+// addPriceRange bounds the price by priceMin and priceMax, each of which
+// may be nil.
+func (q *itemQuery) addPriceRange(priceMin, priceMax *int64) {
+	if priceMin != nil {
+		q.addFilter(ItemFilter{MinPrice: priceMin})
+	}
+	if priceMax != nil {
+		q.addFilter(ItemFilter{MaxPrice: priceMax})
+	}
+}
+
+func (q *itemQuery) addFilter(f ItemFilter) {
+	cond, args := filterCondition(f)
+	q.add(cond, args...)
+}
+
+// addAny adds a condition matching when at least one of filters does.
+func (q *itemQuery) addAny(filters []ItemFilter) {
+	var conds []string
+	for _, f := range filters {
+		cond, args := filterCondition(f)
+		conds = append(conds, cond)
+		q.args = append(q.args, args...)
+	}
+	q.where = append(q.where, "("+strings.Join(conds, " OR ")+")")
+}
+
+// filterCondition is the SQL of a filter primitive, which the listings,
+// GET /search and POST /search all build their conditions from.
+func filterCondition(f ItemFilter) (string, []interface{}) {
+	switch {
+	case f.Keyword != nil:
+		pattern := likePattern(*f.Keyword)
+		return `(LOWER(items.name) LIKE LOWER(?) ESCAPE '\' OR LOWER(categories.name) LIKE LOWER(?) ESCAPE '\')`, []interface{}{pattern, pattern}
+	case f.Category != nil:
+		return "categories.name = ?", []interface{}{normalizeCategory(*f.Category)}
+	case f.MinPrice != nil:
+		return "items.price >= ?", []interface{}{*f.MinPrice}
+	default:
+		return "items.price <= ?", []interface{}{*f.MaxPrice}
+	}
+}
+
+func (q *itemQuery) whereClause() string {
+	where := q.where
+	switch q.deleted {
+	case ExcludeDeleted:
+		where = append(where[:len(where):len(where)], "items.deleted_at IS NULL")
+	case OnlyDeleted:
+		where = append(where[:len(where):len(where)], "items.deleted_at IS NOT NULL")
+	}
+	if len(where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(where, " AND ")
+}
+
+// sql returns the item listing query. A limit of 0 means no limit.
+func (q *itemQuery) sql(order string, limit, offset int) (string, []interface{}) {
+	query := itemSelect + q.join + q.whereClause() + " ORDER BY " + order
+	args := append([]interface{}(nil), q.args...)
+	if limit > 0 || offset > 0 {
+		if limit <= 0 {
+			limit = -1
+		}
+		query += " LIMIT ? OFFSET ?"
+		args = append(args, limit, offset)
+	}
+	return query, args
+}
+
+// countSQL returns a query counting the items matched by q.
+func (q *itemQuery) countSQL() (string, []interface{}) {
+	return "SELECT COUNT(*) FROM items JOIN categories ON items.category_id = categories.id" + q.join + q.whereClause(), q.args
+}
+
+// categoryCountSQL returns a query listing every category by name with
+// the number of its items matched by q, which is 0 when none is.
+func (q *itemQuery) categoryCountSQL() (string, []interface{}) {
+	return `SELECT categories.id, categories.name, COUNT(matched.id) FROM categories
+	LEFT JOIN (SELECT items.id, items.category_id
+		FROM items JOIN categories ON items.category_id = categories.id` + q.join + q.whereClause() + `) AS matched
+	ON matched.category_id = categories.id
+	GROUP BY categories.id ORDER BY categories.name, categories.id`, q.args
+}
+
+func (s ServerImpl) getSearch(c echo.Context) error {
+	keyword := c.QueryParam("keyword")
+	if strings.TrimSpace(keyword) == "" {
+		return newAPIError(http.StatusBadRequest, CodeInvalidQuery, "keyword is required")
+	}
+	opts, err := parseListOptions(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidQuery, err.Error())
+	}
+	items, err := s.repo.SearchItems(c.Request().Context(), keyword, opts)
+	if err != nil {
+		c.Logger().Errorf("Error while searching items with keyword %s: %s", keyword, err)
+		return dbError(err, "Error while searching items")
+	}
+	s.setImageURLs(c, items.Items)
+	return c.JSON(http.StatusOK, items)
+}
+
+// decodeSearchRequest parses and validates a POST /search body.
+func decodeSearchRequest(body io.Reader) (SearchRequest, error) {
+	var req SearchRequest
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		var se *schemaError
+		switch {
+		case errors.As(err, &se):
+			return SearchRequest{}, err
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			return SearchRequest{}, &schemaError{"unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")}
+		}
+		var te *json.UnmarshalTypeError
+		if errors.As(err, &te) {
+			return SearchRequest{}, &schemaError{fmt.Sprintf("field %q must be of type %s", te.Field, te.Type)}
+		}
+		return SearchRequest{}, err
+	}
+	if dec.More() {
+		return SearchRequest{}, errors.New("unexpected data after the request body")
+	}
+
+	if _, ok := searchSorts[req.Sort]; !ok {
+		return SearchRequest{}, &schemaError{fmt.Sprintf("unknown sort %q", req.Sort)}
+	}
+	switch {
+	case req.Limit == 0:
+		req.Limit = DefaultSearchLimit
+	case req.Limit < 0 || req.Limit > MaxSearchLimit:
+		return SearchRequest{}, &schemaError{fmt.Sprintf("limit must be between 1 and %d", MaxSearchLimit)}
+	}
+	return req, nil
+}
+
+func (req SearchRequest) query() itemQuery {
+	var q itemQuery
+	if req.Keyword != "" {
+		q.addKeyword(req.Keyword)
+	}
+	if req.Filters != nil {
+		for _, f := range req.Filters.All {
+			q.addFilter(f)
+		}
+		if len(req.Filters.Any) > 0 {
+			q.addAny(req.Filters.Any)
+		}
+	}
+	return q
+}
+
+func (s ServerImpl) postSearch(c echo.Context) error {
+	req, err := decodeSearchRequest(c.Request().Body)
+	if err != nil {
+		var se *schemaError
+		if errors.As(err, &se) {
+			return newAPIError(http.StatusUnprocessableEntity, CodeUnprocessable, se.msg)
+		}
+		return newAPIError(http.StatusBadRequest, CodeInvalidJSON, "Invalid JSON body: "+err.Error())
+	}
+
+	items, err := s.repo.QueryItems(c.Request().Context(), req)
+	if err != nil {
+		c.Logger().Errorf("Error while searching items: %s", err)
+		return dbError(err, "Error while searching items")
+	}
+	s.setImageURLs(c, items)
+	return c.JSON(http.StatusOK, items)
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	DBPath     = "../db/mercari.sqlite3"
+	SchemaPath = "../db/items.db"
+
+	// QueryTimeout bounds each repository call, including the time spent
+	// waiting for a lock.
+	QueryTimeout = 3 * time.Second
+
+	// BusyTimeout is how long a statement waits for another process's
+	// lock before failing with SQLITE_BUSY. It is well under QueryTimeout
+	// so that SaveItems has the time to retry.
+	BusyTimeout = 1 * time.Second
+	// MaxDBConns bounds the pool of readers. WAL lets them run alongside
+	// the one writer, so a few connections help, but each holds its own
+	// cache.
+	MaxDBConns = 8
+)
+
+// dsnOptions are applied by go-sqlite3 to every connection it opens;
+// PRAGMA statements after sql.Open would only reach one of the pool.
+var dsnOptions = fmt.Sprintf("_journal_mode=WAL&_synchronous=NORMAL&_foreign_keys=on&_busy_timeout=%d", BusyTimeout.Milliseconds())
+
+// writerOptions start the writer's transactions with BEGIN IMMEDIATE, so
+// that a transaction that reads before it writes waits for the write lock
+// up front, instead of failing with "database is locked" when it tries to
+// upgrade.
+const writerOptions = "&_txlock=immediate"
+
+// sqliteRepository is the default ItemRepository, backed by the schema in
+// db/items.db.
+type sqliteRepository struct {
+	// db runs the reads, in deferred transactions that never wait for
+	// the writer.
+	db *sql.DB
+	// writer runs everything that writes on a single connection, since
+	// SQLite only has one writer at a time anyway: writes queue in the
+	// pool, bounded by their context, instead of in busy waits.
+	writer *sql.DB
+	// fts is set when SearchItems can use the items_fts index.
+	fts bool
+}
+
+var (
+	_ ItemRepository          = (*sqliteRepository)(nil)
+	_ CategoryAliasRepository = (*sqliteRepository)(nil)
+)
+
+func newSQLiteRepository(path string) (*sqliteRepository, error) {
+	db, err := connectDB(path)
+	if err != nil {
+		return nil, err
+	}
+	fts, err := setupFTS(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	writer, err := sql.Open("sqlite3", path+"?"+dsnOptions+writerOptions)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	writer.SetMaxOpenConns(1)
+	return &sqliteRepository{db: db, writer: writer, fts: fts}, nil
+}
+
+// connectDB opens the sqlite database at path and applies the schema.
+func connectDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path+"?"+dsnOptions)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(MaxDBConns)
+	db.SetMaxIdleConns(MaxDBConns)
+	// sql.Open does not touch the file; Ping makes sure it can be opened.
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening database %s: %w", path, err)
+	}
+	schema, err := os.ReadFile(SchemaPath)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(string(schema)); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// columnMigrations lists the columns added to tables after their first
+// release. CREATE TABLE IF NOT EXISTS leaves older databases without
+// them, so migrate adds the ones that are missing.
+var columnMigrations = []struct {
+	table, column, definition string
+}{
+	{"items", "created_at", "TEXT"},
+	{"items", "updated_at", "TEXT"},
+	{"items", "price", "INTEGER NOT NULL DEFAULT 0"},
+	{"items", "deleted_at", "TEXT"},
+}
+
+func migrate(db *sql.DB) error {
+	for _, m := range columnMigrations {
+		var exists bool
+		if err := db.QueryRow("SELECT EXISTS (SELECT 1 FROM pragma_table_info(?) WHERE name = ?)", m.table, m.column).Scan(&exists); err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.table, m.column, m.definition)); err != nil {
+			return fmt.Errorf("adding %s.%s: %w", m.table, m.column, err)
+		}
+	}
+	return uniqueCategoryNames(db)
+}
+
+// uniqueCategoryNames adds the UNIQUE index on categories.name to
+// databases created before the schema had it. Concurrent inserts could
+// create the same category twice back then, so duplicates are first
+// merged into the oldest row of each name.
+func uniqueCategoryNames(db *sql.DB) error {
+	var exists bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM pragma_index_list('categories') AS il
+		JOIN pragma_index_info(il.name) AS ii WHERE il."unique" AND ii.name = 'name')`).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const oldest = "(SELECT MIN(c.id) FROM categories AS c WHERE c.name = (SELECT name FROM categories WHERE id = category_id))"
+	for _, stmt := range []string{
+		"UPDATE items SET category_id = " + oldest,
+		"UPDATE category_aliases SET category_id = " + oldest,
+		"DELETE FROM categories WHERE id > (SELECT MIN(c.id) FROM categories AS c WHERE c.name = categories.name)",
+		"CREATE UNIQUE INDEX categories_name ON categories (name)",
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("making category names unique: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (r *sqliteRepository) Ping(ctx context.Context) error {
+	if err := r.db.PingContext(ctx); err != nil {
+		return err
+	}
+	var one int
+	return r.db.QueryRowContext(ctx, "SELECT 1").Scan(&one)
+}
+
+func (r *sqliteRepository) Close() error {
+	werr := r.writer.Close()
+	if err := r.db.Close(); err != nil {
+		return err
+	}
+	return werr
+}
+
+// checkCategoryId returns the id of the category called name, resolving
+// aliases first and creating the category if it does not exist yet.
+func checkCategoryId(ctx context.Context, tx *sql.Tx, name string) (int64, error) {
+	name = normalizeCategory(name)
+
+	var id int64
+	err := tx.QueryRowContext(ctx, "SELECT category_id FROM category_aliases WHERE alias = ?", name).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	err = tx.QueryRowContext(ctx, "SELECT id FROM categories WHERE name = ?", name).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	// Another request may insert the same category between the SELECT and
+	// here; the UNIQUE constraint turns that into a no-op and the winner's
+	// row is read back.
+	if _, err := tx.ExecContext(ctx, "INSERT INTO categories (name) VALUES (?) ON CONFLICT (name) DO NOTHING", name); err != nil {
+		return 0, err
+	}
+	err = tx.QueryRowContext(ctx, "SELECT id FROM categories WHERE name = ?", name).Scan(&id)
+	return id, err
+}
+
+func (r *sqliteRepository) CheckCategoryId(ctx context.Context, name string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	tx, err := r.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	id, err := checkCategoryId(ctx, tx, name)
+	if err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func (r *sqliteRepository) ReadCategories(ctx context.Context, keywords string, opts ListOptions) (Categories, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	opts.Category = ""
+	q, _ := r.searchQuery(keywords, opts)
+	query, args := q.categoryCountSQL()
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return Categories{}, err
+	}
+	defer rows.Close()
+
+	categories := Categories{Categories: []CategoryCount{}}
+	for rows.Next() {
+		var c CategoryCount
+		if err := rows.Scan(&c.ID, &c.Name, &c.ItemCount); err != nil {
+			return Categories{}, err
+		}
+		categories.Categories = append(categories.Categories, c)
+	}
+	return categories, rows.Err()
+}
+
+func (r *sqliteRepository) GetCategory(ctx context.Context, id int64) (Category, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	c := Category{ID: id}
+	err := r.db.QueryRowContext(ctx, "SELECT name FROM categories WHERE id = ?", id).Scan(&c.Name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Category{}, errCategoryNotFound
+	}
+	return c, err
+}
+
+func (r *sqliteRepository) SaveItem(ctx context.Context, item Item) (Item, error) {
+	saved, err := r.SaveItems(ctx, []Item{item})
+	if err != nil {
+		return Item{}, err
+	}
+	return saved[0], nil
+}
+
+// SaveItems retries once if the database stays locked for longer than
+// BusyTimeout, which the add-item path hits under bursts of writes.
+func (r *sqliteRepository) SaveItems(ctx context.Context, items []Item) ([]Item, error) {
+	saved, err := r.saveItems(ctx, items)
+	if isBusy(err) {
+		saved, err = r.saveItems(ctx, items)
+	}
+	return saved, err
+}
+
+func (r *sqliteRepository) saveItems(ctx context.Context, items []Item) ([]Item, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	tx, err := r.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := timestamp()
+	saved := make([]Item, len(items))
+	for i, item := range items {
+		categoryId, err := checkCategoryId(ctx, tx, item.Category)
+		if err != nil {
+			return nil, err
+		}
+		res, err := tx.ExecContext(ctx, "INSERT INTO items (name, category_id, image_name, price, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)", item.Name, categoryId, item.ImageName, item.Price, now, now)
+		if err != nil {
+			return nil, err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return nil, err
+		}
+		if saved[i], err = scanItem(tx.QueryRowContext(ctx, itemSelect+" WHERE items.id = ?", id)); err != nil {
+			return nil, err
+		}
+	}
+	return saved, tx.Commit()
+}
+
+func (r *sqliteRepository) UpdateItem(ctx context.Context, id int64, name, category, imageName string, price int64) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	tx, err := r.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return "", false, err
+	}
+	defer tx.Rollback()
+
+	var oldImage string
+	err = tx.QueryRowContext(ctx, "SELECT image_name FROM items WHERE id = ? AND deleted_at IS NULL", id).Scan(&oldImage)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, ErrItemNotFound
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if imageName == "" {
+		imageName = oldImage
+	}
+
+	categoryId, err := checkCategoryId(ctx, tx, category)
+	if err != nil {
+		return "", false, err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE items SET name = ?, category_id = ?, image_name = ?, price = ?, updated_at = ? WHERE id = ?", name, categoryId, imageName, price, timestamp(), id); err != nil {
+		return "", false, err
+	}
+
+	orphaned, err := imageOrphaned(ctx, tx, oldImage)
+	if err != nil {
+		return "", false, err
+	}
+	return oldImage, orphaned, tx.Commit()
+}
+
+// imageOrphaned reports whether imageName is set but no item uses it.
+func imageOrphaned(ctx context.Context, tx *sql.Tx, imageName string) (bool, error) {
+	if imageName == "" {
+		return false, nil
+	}
+	var refs int
+	if err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM items WHERE image_name = ?", imageName).Scan(&refs); err != nil {
+		return false, err
+	}
+	return refs == 0, nil
+}
+
+func (r *sqliteRepository) DeleteItem(ctx context.Context, id int64) (Item, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	tx, err := r.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return Item{}, false, err
+	}
+	defer tx.Rollback()
+
+	item, err := scanItem(tx.QueryRowContext(ctx, itemSelect+" WHERE items.id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Item{}, false, ErrItemNotFound
+	}
+	if err != nil {
+		return Item{}, false, err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM items WHERE id = ?", id); err != nil {
+		return Item{}, false, err
+	}
+
+	orphaned, err := imageOrphaned(ctx, tx, item.ImageName)
+	if err != nil {
+		return Item{}, false, err
+	}
+	return item, orphaned, tx.Commit()
+}
+
+func (r *sqliteRepository) ImportItems(ctx context.Context, items []Item) ([]bool, error) {
+	tx, err := r.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	now := timestamp()
+	inserted := make([]bool, len(items))
+	for i, item := range items {
+		categoryId, err := checkCategoryId(ctx, tx, item.Category)
+		if err != nil {
+			return nil, err
+		}
+		var exists bool
+		if err := tx.QueryRowContext(ctx, "SELECT EXISTS (SELECT 1 FROM items WHERE name = ? AND category_id = ? AND image_name = ?)", item.Name, categoryId, item.ImageName).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO items (name, category_id, image_name, price, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)", item.Name, categoryId, item.ImageName, item.Price, now, now); err != nil {
+			return nil, err
+		}
+		inserted[i] = true
+	}
+	return inserted, tx.Commit()
+}
+
+func (r *sqliteRepository) queryItems(ctx context.Context, q itemQuery, order string, limit int) (Items, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	query, args := q.sql(order, limit, 0)
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return Items{}, err
+	}
+	defer rows.Close()
+	return ScanRowsToItems(rows)
+}
+
+func (r *sqliteRepository) ImageNames(ctx context.Context) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, "SELECT DISTINCT image_name FROM items WHERE image_name != ''")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names[name] = true
+	}
+	return names, rows.Err()
+}
+
+// listQuery selects the items matched by the filters of opts.
+func listQuery(opts ListOptions) itemQuery {
+	q := itemQuery{deleted: opts.Deleted}
+	if opts.Category != "" {
+		q.addCategory(opts.Category)
+	}
+	q.addPriceRange(opts.PriceMin, opts.PriceMax)
+	return q
+}
+
+func (r *sqliteRepository) ReadItems(ctx context.Context, opts ListOptions) (ItemsPage, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	return r.readPage(ctx, listQuery(opts), listSorts[opts.Sort], opts.Page)
+}
+
+// readPage returns a page of the items matched by q in the given order,
+// with the number of matches across all pages.
+func (r *sqliteRepository) readPage(ctx context.Context, q itemQuery, order string, page Page) (ItemsPage, error) {
+	// Count and list in one transaction so total matches the page. It is
+	// a deferred one on the readers, so it reads a snapshot instead of
+	// waiting for the writer.
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return ItemsPage{}, err
+	}
+	defer tx.Rollback()
+
+	var res ItemsPage
+	countQuery, countArgs := q.countSQL()
+	if err := tx.QueryRowContext(ctx, countQuery, countArgs...).Scan(&res.Total); err != nil {
+		return ItemsPage{}, err
+	}
+	// The total covers the pages before the cursor too.
+	if page.After > 0 {
+		q.add("items.id > ?", page.After)
+	}
+	query, args := q.sql(order, page.Limit, page.Offset)
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return ItemsPage{}, err
+	}
+	defer rows.Close()
+	if res.Items, err = ScanRowsToItems(rows); err != nil {
+		return ItemsPage{}, err
+	}
+	return res, nil
+}
+
+// SearchItems ranks matches with the full-text index when there is one.
+// Otherwise each term is matched with LIKE, in id order.
+func (r *sqliteRepository) SearchItems(ctx context.Context, keywords string, opts ListOptions) (ItemsPage, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	q, ranked := r.searchQuery(keywords, opts)
+	order := listSorts[opts.Sort]
+	if ranked && opts.Sort == "" {
+		order = ftsOrder
+	}
+	return r.readPage(ctx, q, order, opts.Page)
+}
+
+// searchQuery matches keywords on top of the filters of opts, and reports
+// whether it goes through the full-text index, whose matches have a rank.
+func (r *sqliteRepository) searchQuery(keywords string, opts ListOptions) (itemQuery, bool) {
+	q := listQuery(opts)
+	if !r.fts {
+		q.addKeywords(keywords)
+		return q, false
+	}
+	return q, q.addFullText(keywords)
+}
+
+func (r *sqliteRepository) CountItems(ctx context.Context, keywords string, opts ListOptions) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	q, _ := r.searchQuery(keywords, opts)
+	query, args := q.countSQL()
+	var n int
+	err := r.db.QueryRowContext(ctx, query, args...).Scan(&n)
+	return n, err
+}
+
+func (r *sqliteRepository) QueryItems(ctx context.Context, req SearchRequest) (Items, error) {
+	return r.queryItems(ctx, req.query(), searchSorts[req.Sort], req.Limit)
+}
+
+func (r *sqliteRepository) EachItem(ctx context.Context, opts ListOptions, fn func(Item) error) error {
+	q := listQuery(opts)
+	query, args := q.sql(listSorts[opts.Sort], 0, 0)
+	rows, err := r.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (r *sqliteRepository) GetItem(ctx context.Context, id int64) (Item, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	item, err := scanItem(r.db.QueryRowContext(ctx, itemSelect+" WHERE items.id = ? AND items.deleted_at IS NULL", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Item{}, ErrItemNotFound
+	}
+	return item, err
+}
+
+func (r *sqliteRepository) TrashItem(ctx context.Context, id int64) (Item, error) {
+	return r.setDeletedAt(ctx, id, timestamp(), "deleted_at IS NULL")
+}
+
+func (r *sqliteRepository) RestoreItem(ctx context.Context, id int64) (Item, error) {
+	return r.setDeletedAt(ctx, id, nil, "deleted_at IS NOT NULL")
+}
+
+// setDeletedAt sets deleted_at of the item with the id if it meets cond,
+// which selects whether it is in the trash.
+func (r *sqliteRepository) setDeletedAt(ctx context.Context, id int64, deletedAt interface{}, cond string) (Item, error) {
+	ctx, cancel := context.WithTimeout(ctx, QueryTimeout)
+	defer cancel()
+
+	tx, err := r.writer.BeginTx(ctx, nil)
+	if err != nil {
+		return Item{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "UPDATE items SET deleted_at = ? WHERE id = ? AND "+cond, deletedAt, id)
+	if err != nil {
+		return Item{}, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return Item{}, err
+	} else if n == 0 {
+		return Item{}, ErrItemNotFound
+	}
+	item, err := scanItem(tx.QueryRowContext(ctx, itemSelect+" WHERE items.id = ?", id))
+	if err != nil {
+		return Item{}, err
+	}
+	return item, tx.Commit()
+}
+
+// scanItem reads an item selected with itemSelect from a *sql.Row or
+// *sql.Rows. Timestamps are NULL for rows older than the columns and
+// come out as "".
+func scanItem(row interface{ Scan(...interface{}) error }) (Item, error) {
+	var item Item
+	var createdAt, updatedAt, deletedAt sql.NullString
+	err := row.Scan(&item.ID, &item.Name, &item.Category, &item.ImageName, &item.Price, &createdAt, &updatedAt, &deletedAt)
+	item.CreatedAt, item.UpdatedAt, item.DeletedAt = createdAt.String, updatedAt.String, deletedAt.String
+	return item, err
+}
+
+func ScanRowsToItems(rows *sql.Rows) (Items, error) {
+	items := Items{Items: []Item{}}
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			return Items{}, err
+		}
+		items.Items = append(items.Items, item)
+	}
+	// Next also returns false when reading a row fails, which is only
+	// reported here.
+	if err := rows.Err(); err != nil {
+		return Items{}, err
+	}
+	return items, nil
+}
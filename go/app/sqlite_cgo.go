@@ -0,0 +1,17 @@
+//go:build cgo
+
+package main
+
+import (
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const sqliteSupported = true
+
+// isBusy reports whether err is SQLite giving up on a lock.
+func isBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
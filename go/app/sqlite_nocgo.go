@@ -0,0 +1,9 @@
+//go:build !cgo
+
+package main
+
+// go-sqlite3 is only a stub without cgo, so such builds can only use
+// STORAGE=json.
+const sqliteSupported = false
+
+func isBusy(error) bool { return false }
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// newTestSQLite opens a sqlite repository on a temporary file.
+func newTestSQLite(t *testing.T) *sqliteRepository {
+	t.Helper()
+	if !sqliteSupported {
+		t.Skip("built without sqlite support")
+	}
+	r, err := newSQLiteRepository(filepath.Join(t.TempDir(), "mercari.sqlite3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+// TestConcurrentAddItem posts items from several goroutines at once,
+// which must all be saved without the database reporting it is locked.
+func TestConcurrentAddItem(t *testing.T) {
+	const workers, perWorker = 8, 20
+	repo := newTestSQLite(t)
+	e := newTestServer(t, testConfig(t), repo)
+
+	var wg sync.WaitGroup
+	errs := make(chan string, workers*perWorker)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				// A new category each time also exercises CheckCategoryId.
+				rec := serve(e, form(http.MethodPost, "/items", "name", fmt.Sprintf("item %d-%d", w, i), "category", fmt.Sprintf("category %d", i))())
+				if rec.Code != http.StatusCreated {
+					errs <- fmt.Sprintf("status %d: %s", rec.Code, rec.Body)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	rec := serve(e, get("/items/count")())
+	if want := fmt.Sprintf(`{"count":%d}`, workers*perWorker); rec.Body.String() != want+"\n" {
+		t.Errorf("count = %s, want %s", rec.Body, want)
+	}
+}
+
+// seedSorts stores items whose orders differ for every sort key: names
+// tie on "apple", and item 2 was stored before created_at existed.
+func seedSorts(t *testing.T, r *sqliteRepository) {
+	t.Helper()
+	ctx := context.Background()
+	for _, name := range []string{"banana", "apple", "cherry", "apple"} {
+		if _, err := r.SaveItem(ctx, Item{Name: name, Category: "fruit"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	createdAt := []interface{}{"2024-03-01T00:00:00Z", nil, "2024-01-01T00:00:00Z", "2024-02-01T00:00:00Z"}
+	for i, v := range createdAt {
+		if _, err := r.writer.Exec("UPDATE items SET created_at = ? WHERE id = ?", v, i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func idsOf(items []Item) []int64 {
+	ids := []int64{}
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	return ids
+}
+
+func TestSQLiteListSorts(t *testing.T) {
+	r := newTestSQLite(t)
+	seedSorts(t, r)
+	tests := map[string][]int64{
+		"":       {1, 2, 3, 4},
+		"newest": {1, 4, 3, 2},
+		"oldest": {2, 3, 4, 1},
+		"name":   {2, 4, 1, 3},
+	}
+	if len(tests) != len(listSorts) {
+		t.Fatalf("%d list sorts tested, want all %d", len(tests), len(listSorts))
+	}
+	for sort, want := range tests {
+		page, err := r.ReadItems(context.Background(), ListOptions{Sort: sort})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := idsOf(page.Items.Items); !reflect.DeepEqual(got, want) {
+			t.Errorf("sort %q: ids = %v, want %v", sort, got, want)
+		}
+	}
+}
+
+func TestSQLiteSearchSorts(t *testing.T) {
+	r := newTestSQLite(t)
+	seedSorts(t, r)
+	tests := map[string][]int64{
+		"":            {1, 2, 3, 4},
+		"id":          {1, 2, 3, 4},
+		"-id":         {4, 3, 2, 1},
+		"name":        {2, 4, 1, 3},
+		"-name":       {3, 1, 4, 2},
+		"created_at":  {2, 3, 4, 1},
+		"-created_at": {1, 4, 3, 2},
+	}
+	if len(tests) != len(searchSorts) {
+		t.Fatalf("%d search sorts tested, want all %d", len(tests), len(searchSorts))
+	}
+	for sort, want := range tests {
+		items, err := r.QueryItems(context.Background(), SearchRequest{Sort: sort, Limit: MaxSearchLimit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := idsOf(items.Items); !reflect.DeepEqual(got, want) {
+			t.Errorf("sort %q: ids = %v, want %v", sort, got, want)
+		}
+	}
+}
+
+// TestSQLiteNullTimestamps reads an item stored before the timestamps
+// existed, whose NULLs come back as "".
+func TestSQLiteNullTimestamps(t *testing.T) {
+	r := newTestSQLite(t)
+	seedSorts(t, r)
+	if _, err := r.writer.Exec("UPDATE items SET updated_at = NULL WHERE id = 2"); err != nil {
+		t.Fatal(err)
+	}
+	item, err := r.GetItem(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.CreatedAt != "" || item.UpdatedAt != "" {
+		t.Errorf("timestamps = %q, %q, want empty", item.CreatedAt, item.UpdatedAt)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// StreamFlushItems is how many items GET /items?stream=true buffers
+// before flushing them to the client.
+const StreamFlushItems = 500
+
+// streamItems answers GET /items?stream=true. It lists every matching
+// item without paging, writing each one as it is read instead of
+// building the whole listing in memory, and bypasses the cache. The body
+// is byte for byte what the buffered listing would be, less next_cursor,
+// with total being the number of items written; ?pretty is not supported.
+func (s ServerImpl) streamItems(c echo.Context, opts ListOptions) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	// Nothing reaches res until buf fills or is flushed, so an error on
+	// the first rows can still be answered with a status.
+	buf := bufio.NewWriter(res)
+	buf.WriteString(`{"items":[`)
+
+	n := 0
+	err := s.repo.EachItem(c.Request().Context(), opts, func(item Item) error {
+		s.setImageURL(c, &item)
+		b, err := json.Marshal(item)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			buf.WriteByte(',')
+		}
+		if _, err := buf.Write(b); err != nil {
+			return err
+		}
+		n++
+		if n%StreamFlushItems == 0 {
+			if err := buf.Flush(); err != nil {
+				return err
+			}
+			res.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		buf.WriteString(`],"total":` + strconv.Itoa(n) + "}\n")
+		err = buf.Flush()
+	}
+	if err != nil {
+		c.Logger().Errorf("Error while streaming items: %s", err)
+		// Once items have gone out the status can no longer change, and
+		// the client sees truncated JSON.
+		if !res.Committed {
+			return dbError(err, "Error while reading items")
+		}
+	}
+	return nil
+}
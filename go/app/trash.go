@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// trashItem implements the default DELETE /items/:id. The image of a
+// trashed item is kept, so that restoring it brings the image back.
+func (s ServerImpl) trashItem(c echo.Context, id int64) error {
+	item, err := s.repo.TrashItem(c.Request().Context(), id)
+	s.cache.invalidate()
+	if errors.Is(err, ErrItemNotFound) {
+		return newAPIError(http.StatusNotFound, CodeItemNotFound, "Item not found")
+	}
+	if err != nil {
+		c.Logger().Errorf("Error while trashing item with ID %d: %s", id, err)
+		return dbError(err, "Error while deleting item")
+	}
+	message := fmt.Sprintf("item moved to trash: %s", item.Name)
+	return c.JSON(http.StatusOK, Response{Message: message})
+}
+
+// getTrash lists the items in the trash, taking the same query
+// parameters as GET /items.
+func (s ServerImpl) getTrash(c echo.Context) error {
+	opts, err := parseListOptions(c)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidQuery, err.Error())
+	}
+	if s.listNotModified(c) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	opts.Deleted = OnlyDeleted
+	items, err := s.cache.readItems(c.Request().Context(), s.repo, opts)
+	if err != nil {
+		c.Logger().Errorf("Error while reading the trash: %s", err)
+		return dbError(err, "Error while reading items")
+	}
+	s.setImageURLs(c, items.Items)
+	return c.JSON(http.StatusOK, items)
+}
+
+func (s ServerImpl) restoreItem(c echo.Context) error {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return newAPIError(http.StatusBadRequest, CodeInvalidID, "Item id must be an integer")
+	}
+	item, err := s.repo.RestoreItem(c.Request().Context(), id)
+	s.cache.invalidate()
+	if errors.Is(err, ErrItemNotFound) {
+		return newAPIError(http.StatusNotFound, CodeItemNotFound, "Item not found in the trash")
+	}
+	if err != nil {
+		c.Logger().Errorf("Error while restoring item with ID %d: %s", id, err)
+		return dbError(err, "Error while restoring item")
+	}
+	s.setImageURL(c, &item)
+	return c.JSON(http.StatusOK, item)
+}
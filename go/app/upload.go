@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// UploadSessionTTL is how long an upload session may stay idle before
+	// it is garbage-collected together with its partial data.
+	UploadSessionTTL = 24 * time.Hour
+	// UploadOffsetHeader carries the offset a chunk starts at.
+	UploadOffsetHeader = "Upload-Offset"
+)
+
+type UploadStatus struct {
+	ID     string `json:"id"`
+	Size   int64  `json:"size"`
+	Offset int64  `json:"offset"`
+}
+
+type CommitResponse struct {
+	ImageName string `json:"image_name"`
+}
+
+type uploadSession struct {
+	mu        sync.Mutex
+	id        string
+	size      int64
+	offset    int64
+	path      string
+	updatedAt time.Time
+	done      bool
+}
+
+func (s *uploadSession) status() UploadStatus {
+	return UploadStatus{ID: s.id, Size: s.size, Offset: s.offset}
+}
+
+// uploadStore keeps the resumable upload sessions. Partial data lives in
+// dir, inside imgDir so that a committed upload can be renamed into place.
+// Uploads are capped by the BodyLimit of conf, like single-request ones.
+type uploadStore struct {
+	mu       sync.Mutex
+	conf     *configHolder
+	imgDir   string
+	dir      string
+	ttl      time.Duration
+	sessions map[string]*uploadSession
+}
+
+func newUploadStore(conf *configHolder, imgDir string, ttl time.Duration) *uploadStore {
+	return &uploadStore{
+		conf:     conf,
+		imgDir:   imgDir,
+		dir:      path.Join(imgDir, ".resumable"),
+		ttl:      ttl,
+		sessions: make(map[string]*uploadSession),
+	}
+}
+
+// init creates the session directory and drops partial data left behind by
+// a previous process, since the sessions referencing it are gone.
+func (u *uploadStore) init() error {
+	if err := os.RemoveAll(u.dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(u.dir, 0o755)
+}
+
+func (u *uploadStore) get(id string) (*uploadSession, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	s, ok := u.sessions[id]
+	return s, ok
+}
+
+func (u *uploadStore) remove(s *uploadSession) {
+	u.mu.Lock()
+	delete(u.sessions, s.id)
+	u.mu.Unlock()
+	os.Remove(s.path)
+}
+
+// gc removes sessions which have not been touched within the TTL.
+func (u *uploadStore) gc(now time.Time) int {
+	u.mu.Lock()
+	var stale []*uploadSession
+	for _, s := range u.sessions {
+		stale = append(stale, s)
+	}
+	u.mu.Unlock()
+
+	removed := 0
+	for _, s := range stale {
+		s.mu.Lock()
+		expired := !s.done && now.Sub(s.updatedAt) > u.ttl
+		if expired {
+			s.done = true
+		}
+		s.mu.Unlock()
+		if expired {
+			u.remove(s)
+			removed++
+		}
+	}
+	return removed
+}
+
+func (u *uploadStore) gcLoop(logger echo.Logger) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if n := u.gc(now); n > 0 {
+			logger.Infof("Removed %d stale upload sessions", n)
+		}
+	}
+}
+
+func newUploadID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// create starts an upload session for a file of the declared size.
+func (u *uploadStore) create(c echo.Context) error {
+	size, err := strconv.ParseInt(c.FormValue("size"), 10, 64)
+	if err != nil || size <= 0 {
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "size must be a positive integer")
+	}
+	if limit := u.conf.Load().BodyLimit; limit > 0 && size > limit {
+		return tooLarge(limit)
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		c.Logger().Errorf("Error while creating upload id: %s", err)
+		return newAPIError(http.StatusInternalServerError, CodeInternal, "Error while creating upload session")
+	}
+	s := &uploadSession{
+		id:        id,
+		size:      size,
+		path:      path.Join(u.dir, id),
+		updatedAt: time.Now(),
+	}
+	f, err := os.Create(s.path)
+	if err != nil {
+		c.Logger().Errorf("Error while creating upload file: %s", err)
+		return newAPIError(http.StatusInternalServerError, CodeInternal, "Error while creating upload session")
+	}
+	f.Close()
+
+	u.mu.Lock()
+	u.sessions[id] = s
+	u.mu.Unlock()
+
+	c.Logger().Infof("Created upload session %s (%d bytes)", id, size)
+	c.Response().Header().Set(echo.HeaderLocation, "/uploads/resumable/"+id)
+	return c.JSON(http.StatusCreated, s.status())
+}
+
+// status reports the current offset so a client can resume.
+func (u *uploadStore) status(c echo.Context) error {
+	s, ok := u.get(c.Param("id"))
+	if !ok {
+		return newAPIError(http.StatusNotFound, CodeNotFound, "Upload session not found")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.Response().Header().Set(UploadOffsetHeader, strconv.FormatInt(s.offset, 10))
+	return c.JSON(http.StatusOK, s.status())
+}
+
+// appendChunk writes the request body at the offset given in the
+// Upload-Offset header. Chunks must be contiguous: anything that does not
+// start exactly at the current offset is rejected with 409.
+func (u *uploadStore) appendChunk(c echo.Context) error {
+	s, ok := u.get(c.Param("id"))
+	if !ok {
+		return newAPIError(http.StatusNotFound, CodeNotFound, "Upload session not found")
+	}
+	offset, err := strconv.ParseInt(c.Request().Header.Get(UploadOffsetHeader), 10, 64)
+	if err != nil || offset < 0 {
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, UploadOffsetHeader+" header must be a non-negative integer")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return newAPIError(http.StatusNotFound, CodeNotFound, "Upload session not found")
+	}
+	if offset != s.offset {
+		c.Response().Header().Set(UploadOffsetHeader, strconv.FormatInt(s.offset, 10))
+		return newAPIError(http.StatusConflict, CodeConflict, "Chunk offset "+strconv.FormatInt(offset, 10)+" does not match current offset "+strconv.FormatInt(s.offset, 10))
+	}
+	remaining := s.size - s.offset
+	if cl := c.Request().ContentLength; cl > remaining {
+		return newAPIError(http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Chunk exceeds the declared upload size")
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		c.Logger().Errorf("Error while opening upload file: %s", err)
+		return newAPIError(http.StatusInternalServerError, CodeInternal, "Error while writing chunk")
+	}
+	defer f.Close()
+
+	// Read one byte past the remaining size to detect oversized bodies
+	// sent without a Content-Length.
+	n, err := io.Copy(f, io.LimitReader(c.Request().Body, remaining+1))
+	if n > remaining {
+		f.Truncate(s.offset)
+		return newAPIError(http.StatusRequestEntityTooLarge, CodePayloadTooLarge, "Chunk exceeds the declared upload size")
+	}
+	// Keep whatever arrived before an interrupted transfer so the client
+	// can resume from there.
+	s.offset += n
+	s.updatedAt = time.Now()
+	c.Response().Header().Set(UploadOffsetHeader, strconv.FormatInt(s.offset, 10))
+	if err != nil {
+		c.Logger().Errorf("Error while receiving chunk for %s: %s", s.id, err)
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "Chunk was interrupted")
+	}
+	return c.JSON(http.StatusOK, s.status())
+}
+
+// commit verifies the assembled file against the sha256 supplied by the
+// client and moves it into the image storage.
+func (u *uploadStore) commit(c echo.Context) error {
+	s, ok := u.get(c.Param("id"))
+	if !ok {
+		return newAPIError(http.StatusNotFound, CodeNotFound, "Upload session not found")
+	}
+	want, err := hex.DecodeString(strings.ToLower(c.FormValue("sha256")))
+	if err != nil || len(want) != sha256.Size {
+		return newAPIError(http.StatusBadRequest, CodeBadRequest, "sha256 must be a hex encoded sha256 digest")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return newAPIError(http.StatusNotFound, CodeNotFound, "Upload session not found")
+	}
+	if s.offset != s.size {
+		return newAPIError(http.StatusConflict, CodeConflict, "Upload is incomplete: "+strconv.FormatInt(s.offset, 10)+" of "+strconv.FormatInt(s.size, 10)+" bytes received")
+	}
+
+	// The limit may have been lowered by a reload since the session began.
+	if limit := u.conf.Load().BodyLimit; limit > 0 && s.size > limit {
+		s.done = true
+		u.remove(s)
+		return tooLarge(limit)
+	}
+
+	sum, err := fileSHA256(s.path)
+	if err != nil {
+		c.Logger().Errorf("Error while hashing upload %s: %s", s.id, err)
+		return newAPIError(http.StatusInternalServerError, CodeInternal, "Error while verifying upload")
+	}
+	if !bytes.Equal(sum, want) {
+		return newAPIError(http.StatusUnprocessableEntity, CodeUnprocessable, "sha256 does not match the uploaded data")
+	}
+
+	imageName, err := storeImage(u.imgDir, s.path, sum)
+	if errors.Is(err, errUnsupportedImage) || errors.Is(err, errInvalidImage) {
+		s.done = true
+		u.remove(s)
+		return newAPIError(http.StatusBadRequest, CodeInvalidImage, err.Error())
+	}
+	if err != nil {
+		c.Logger().Errorf("Error while storing upload %s: %s", s.id, err)
+		return newAPIError(http.StatusInternalServerError, CodeInternal, "Error while saving image")
+	}
+	s.done = true
+	u.remove(s)
+
+	c.Logger().Infof("Committed upload %s as %s", s.id, imageName)
+	return c.JSON(http.StatusOK, CommitResponse{ImageName: imageName})
+}
+
+func fileSHA256(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxItemNameLength is the longest item name accepted, in runes.
+const MaxItemNameLength = 100
+
+// validateItemFields trims name and category and checks that they are
+// usable, returning the trimmed values. The error names the offending
+// field and is meant to be returned to the client as is.
+func validateItemFields(name, category string) (string, string, error) {
+	name = strings.TrimSpace(name)
+	category = strings.TrimSpace(category)
+	switch {
+	case name == "":
+		return "", "", errors.New("name is required")
+	case utf8.RuneCountInString(name) > MaxItemNameLength:
+		return "", "", fmt.Errorf("name must be at most %d characters", MaxItemNameLength)
+	case category == "":
+		return "", "", errors.New("category is required")
+	}
+	return name, category, nil
+}
+
+// parsePrice parses a price in yen given as field. An empty value is 0.
+func parsePrice(field, value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	price, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || price < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", field)
+	}
+	return price, nil
+}
+
+// parsePriceRange reads the optional price_min and price_max query
+// parameters of a listing.
+func parsePriceRange(minValue, maxValue string) (priceMin, priceMax *int64, err error) {
+	if minValue != "" {
+		v, err := parsePrice("price_min", minValue)
+		if err != nil {
+			return nil, nil, err
+		}
+		priceMin = &v
+	}
+	if maxValue != "" {
+		v, err := parsePrice("price_max", maxValue)
+		if err != nil {
+			return nil, nil, err
+		}
+		priceMax = &v
+	}
+	if priceMin != nil && priceMax != nil && *priceMin > *priceMax {
+		return nil, nil, errors.New("price_min must not be greater than price_max")
+	}
+	return priceMin, priceMax, nil
+}
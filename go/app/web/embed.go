@@ -0,0 +1,27 @@
+//go:build !noembed
+
+// Package web holds the built frontend so it can be served by the API
+// binary. Run `go generate ./...` from the go directory to refresh dist
+// from typescript/simple-mercari-web, or build with `-tags noembed` to
+// leave the frontend out entirely.
+package web
+
+import (
+	"embed"
+	"io/fs"
+)
+
+//go:generate sh -c "cd ../../../typescript/simple-mercari-web && npm run build && rm -rf ../../go/app/web/dist/static && cp -R build/. ../../go/app/web/dist/"
+
+//go:embed all:dist
+var dist embed.FS
+
+// FS returns the embedded frontend rooted at the build output, or nil
+// when the binary was built without it.
+func FS() fs.FS {
+	sub, err := fs.Sub(dist, "dist")
+	if err != nil {
+		return nil
+	}
+	return sub
+}
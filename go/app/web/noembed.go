@@ -0,0 +1,10 @@
+//go:build noembed
+
+package web
+
+import "io/fs"
+
+// FS returns nil: the binary was built with -tags noembed.
+func FS() fs.FS {
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// WebhookQueueSize is how many notifications wait for delivery before
+	// new ones are dropped.
+	WebhookQueueSize = 256
+	// WebhookAttempts is how many times a notification is sent before it
+	// is given up on, waiting WebhookRetryDelay times the attempt number
+	// in between.
+	WebhookAttempts   = 3
+	WebhookRetryDelay = 2 * time.Second
+	// WebhookTimeout bounds each attempt.
+	WebhookTimeout = 5 * time.Second
+
+	// WebhookSignatureHeader carries the hex HMAC-SHA256 of the body
+	// keyed with WEBHOOK_SECRET, prefixed with "sha256=".
+	WebhookSignatureHeader = "X-Webhook-Signature-256"
+	WebhookEventHeader     = "X-Webhook-Event"
+)
+
+// ItemCreatedEvent is the body POSTed to WEBHOOK_URL for every new item.
+type ItemCreatedEvent struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	ImageURL string `json:"image_url"`
+}
+
+// webhookNotifier delivers item events to the WebhookURL of the live
+// config from a single goroutine, so that a slow receiver never holds up
+// a request. Events still queued when the process exits are lost.
+type webhookNotifier struct {
+	conf   *configHolder
+	client *http.Client
+	queue  chan ItemCreatedEvent
+}
+
+func newWebhookNotifier(conf *configHolder) *webhookNotifier {
+	return &webhookNotifier{
+		conf:   conf,
+		client: &http.Client{Timeout: WebhookTimeout},
+		queue:  make(chan ItemCreatedEvent, WebhookQueueSize),
+	}
+}
+
+// notify queues the event for the created item, which must have its
+// ImageURL set. It does nothing when WEBHOOK_URL is not set, and reports
+// false if the queue is full and the event was dropped.
+func (w *webhookNotifier) notify(item Item) bool {
+	if w.conf.Load().WebhookURL == "" {
+		return true
+	}
+	select {
+	case w.queue <- ItemCreatedEvent{ID: item.ID, Name: item.Name, Category: item.Category, ImageURL: item.ImageURL}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *webhookNotifier) run(logger echo.Logger) {
+	for ev := range w.queue {
+		w.deliver(logger, ev)
+	}
+}
+
+// deliver sends ev, retrying failed attempts. Errors are logged with the
+// item id so that the event can be replayed by hand.
+func (w *webhookNotifier) deliver(logger echo.Logger, ev ItemCreatedEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		logger.Errorf("Webhook for item %d not sent: %s", ev.ID, err)
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		// Read the config on every attempt so that a reload fixing the
+		// URL or secret applies to the retries.
+		cfg := w.conf.Load()
+		if cfg.WebhookURL == "" {
+			return
+		}
+		retry, err := w.post(cfg, body)
+		if err == nil {
+			logger.Debugf("Webhook for item %d delivered", ev.ID)
+			return
+		}
+		if !retry || attempt == WebhookAttempts {
+			logger.Errorf("Webhook for item %d failed after %d attempts, giving up: %s", ev.ID, attempt, err)
+			return
+		}
+		logger.Warnf("Webhook for item %d failed (attempt %d of %d): %s", ev.ID, attempt, WebhookAttempts, err)
+		time.Sleep(time.Duration(attempt) * WebhookRetryDelay)
+	}
+}
+
+// post makes one delivery attempt and reports whether a failure is worth
+// retrying: network errors, 429 and 5xx are, other statuses are not.
+func (w *webhookNotifier) post(cfg Config, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, cfg.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(WebhookEventHeader, "item.created")
+	if cfg.WebhookSecret != "" {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+webhookSignature(cfg.WebhookSecret, body))
+	}
+	res, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	// Drain a little of the body so that the connection can be reused.
+	io.Copy(io.Discard, io.LimitReader(res.Body, 4<<10))
+	res.Body.Close()
+	if res.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retry = res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+	return retry, fmt.Errorf("%s answered %s", cfg.WebhookURL, res.Status)
+}
+
+// webhookSignature is the hex HMAC-SHA256 of body keyed with secret.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
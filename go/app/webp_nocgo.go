@@ -0,0 +1,17 @@
+//go:build !cgo
+
+package main
+
+import (
+	"errors"
+	"image"
+	"io"
+)
+
+// The WebP encoder needs libwebp, so builds without cgo serve originals
+// only.
+const webpSupported = false
+
+func encodeWebP(io.Writer, image.Image) error {
+	return errors.New("webp encoding requires cgo")
+}